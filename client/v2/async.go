@@ -27,7 +27,10 @@ import (
 // provided callback function will be called. The number of in-flight publish
 // requests is configurable but limited. Once the limit has been reached, the
 // client will block publish requests until the lumberjack server did ACK some
-// queued publish requests.
+// queued publish requests. Callbacks fire in the order batches have been
+// sent. An ACK exceeding the window being ACKed acknowledges the windows sent
+// next, such that a single ACK of a server coalescing ACKs completes multiple
+// publish requests.
 type AsyncClient struct {
 	cl *Client
 
@@ -112,12 +115,37 @@ func (c *AsyncClient) Close() error {
 	return err
 }
 
-// Send publishes a new batch of events by JSON-encoding given batch.
+// Send publishes a new batch of events by JSON-encoding given batch. Events
+// can be maps or any other value supported by the configured JSON encoder,
+// like structs with `json` tags.
 // Send blocks if maximum number of allowed asynchrounous calls is still active.
 // Upon completion cb will be called with last ACKed index into active batch.
-// Returns error if communication or serialization to JSON failed.
+// Returns error if communication or serialization to JSON failed. If the
+// circuit breaker is open, ErrCircuitOpen is returned without calling cb.
 func (c *AsyncClient) Send(cb AsyncSendCallback, data []interface{}) error {
-	if err := c.cl.Send(data); err != nil {
+	return c.SendWithMeta(cb, nil, data)
+}
+
+// SendWithMeta publishes a new batch of events with batch level metadata.
+// See Client.SendWithMeta for details on metadata.
+func (c *AsyncClient) SendWithMeta(
+	cb AsyncSendCallback,
+	meta map[string]interface{},
+	data []interface{},
+) error {
+	if breaker := c.cl.opts.breaker; breaker != nil {
+		if err := breaker.allow(); err != nil {
+			return err
+		}
+
+		userCB := cb
+		cb = func(seq uint32, err error) {
+			breaker.record(err)
+			userCB(seq, err)
+		}
+	}
+
+	if err := c.cl.SendWithMeta(meta, data); err != nil {
 		c.ch <- ackMessage{
 			seq: 0,
 			cb:  cb,
@@ -126,14 +154,23 @@ func (c *AsyncClient) Send(cb AsyncSendCallback, data []interface{}) error {
 		return err
 	}
 
+	window, mapSeq := c.cl.lastWindow()
+	userCB := cb
 	c.ch <- ackMessage{
-		seq: uint32(len(data)),
-		cb:  cb,
+		seq: window,
+		cb:  func(seq uint32, err error) { userCB(mapSeq(seq), err) },
 		err: nil,
 	}
 	return nil
 }
 
+// Skipped returns the number of events dropped from the last batch due to
+// encoding errors or exceeding the event size limit. See SkipEncodeErrors and
+// MaxEventBytes.
+func (c *AsyncClient) Skipped() int {
+	return c.cl.Skipped()
+}
+
 func (c *AsyncClient) startACK() {
 	c.ch = make(chan ackMessage, c.inflight)
 	c.wg.Add(1)
@@ -149,6 +186,9 @@ func (c *AsyncClient) ackLoop() {
 	var seq uint32
 	var err error
 
+	// events ACKed beyond the windows completed so far
+	var excess uint32
+
 	// drain ack queue on error/exit
 	defer func() {
 		if err == nil {
@@ -170,7 +210,7 @@ func (c *AsyncClient) ackLoop() {
 			return
 		}
 
-		seq, err = c.cl.AwaitACK(msg.seq)
+		seq, excess, err = c.cl.awaitCoalescedACK(msg.seq, excess)
 		msg.cb(seq, err)
 		if err != nil {
 			c.cl.Close()
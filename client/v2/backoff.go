@@ -0,0 +1,65 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v2
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff computes the wait duration between retries. Backoff is shared by
+// all retrying client features, like LazyClient reconnecting or a Breaker
+// created via NewBreakerWithBackoff. Implementations must be safe for
+// concurrent use.
+type Backoff interface {
+	// Next returns the duration to wait before retry attempt n, with n
+	// starting at 1 for the first retry.
+	Next(attempt int) time.Duration
+}
+
+// ExpBackoff is the default Backoff. The wait duration doubles with every
+// attempt, starting at Init and being capped at Max. A random jitter of up
+// to half of the duration is subtracted, such that retries of many clients
+// are spread out.
+type ExpBackoff struct {
+	Init time.Duration
+	Max  time.Duration
+}
+
+// NewExpBackoff creates a new exponential backoff with jitter, starting at
+// init and being capped at max.
+func NewExpBackoff(init, max time.Duration) *ExpBackoff {
+	return &ExpBackoff{Init: init, Max: max}
+}
+
+// Next returns the wait duration for the given attempt.
+func (b *ExpBackoff) Next(attempt int) time.Duration {
+	d := b.Init
+	for i := 1; i < attempt && d < math.MaxInt64/2 && (b.Max <= 0 || d < b.Max); i++ {
+		d *= 2
+	}
+	if b.Max > 0 && d > b.Max {
+		d = b.Max
+	}
+
+	if half := int64(d / 2); half > 0 {
+		d -= time.Duration(rand.Int63n(half + 1))
+	}
+	return d
+}
@@ -0,0 +1,148 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v2
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Breaker is a circuit breaker for SyncClient and AsyncClient, configured via
+// the CircuitBreaker option. The breaker opens after a number of consecutive
+// failed publish requests, failing subsequent requests with ErrCircuitOpen.
+// Once the cooldown has passed, the breaker becomes half-open, allowing a
+// single trial request. The breaker closes if the trial succeeds and opens
+// again otherwise. A Breaker can be shared by multiple clients.
+type Breaker struct {
+	threshold int
+	cooldown  time.Duration
+	backoff   Backoff
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	opens    int
+	openedAt time.Time
+}
+
+// BreakerState describes the state of a Breaker.
+type BreakerState int
+
+// Circuit breaker states.
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+// ErrCircuitOpen is returned by clients if the circuit breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// NewBreaker creates a new circuit breaker opening after threshold
+// consecutive failures. The breaker stays open for cooldown, before allowing
+// a trial request. A threshold <= 0 is clamped to 1, opening the breaker on
+// the first failure.
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{threshold: clampThreshold(threshold), cooldown: cooldown}
+}
+
+// NewBreakerWithBackoff creates a new circuit breaker like NewBreaker, but
+// computes the cooldown via backoff. The attempt passed to the backoff is the
+// number of times the breaker has opened since it was last closed, such that
+// the cooldown grows while trial requests keep failing. A threshold <= 0 is
+// clamped to 1.
+func NewBreakerWithBackoff(threshold int, backoff Backoff) *Breaker {
+	return &Breaker{threshold: clampThreshold(threshold), backoff: backoff}
+}
+
+func clampThreshold(threshold int) int {
+	if threshold < 1 {
+		return 1
+	}
+	return threshold
+}
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// State returns the current breaker state. An open breaker whose cooldown has
+// passed is reported as half-open.
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.cooldown {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// allow checks if a new request can be sent. In half-open state only a single
+// trial request is allowed, until its result is recorded.
+func (b *Breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerClosed:
+		return nil
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return ErrCircuitOpen
+		}
+		b.state = BreakerHalfOpen
+		return nil
+	default:
+		// trial request still active
+		return ErrCircuitOpen
+	}
+}
+
+// record updates the breaker state with the result of an allowed request.
+func (b *Breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		b.state = BreakerClosed
+		b.failures = 0
+		b.opens = 0
+		return
+	}
+
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+		if b.backoff != nil {
+			b.opens++
+			b.cooldown = b.backoff.Next(b.opens)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v2
+
+import (
+	"sync"
+	"time"
+)
+
+// BufferedClient accumulates single events and publishes them in batches via
+// an AsyncClient. A batch is published once maxBatchSize events have been
+// added or flushInterval has passed since the first event of the batch has
+// been added.
+type BufferedClient struct {
+	cl *AsyncClient
+	cb BufferedSendCallback
+
+	maxBatchSize  int
+	flushInterval time.Duration
+
+	mu     sync.Mutex
+	events []interface{}
+	timer  *time.Timer
+	closed bool
+
+	// batches taken from the buffer, but not yet passed to the AsyncClient
+	sending sync.WaitGroup
+}
+
+// BufferedSendCallback is called with the events of a published batch, once
+// the batch has been ACKed or an error occurred. See AsyncSendCallback for
+// details on seq and err.
+//
+// Note: The callback MUST not block.
+type BufferedSendCallback func(events []interface{}, seq uint32, err error)
+
+// NewBufferedClient creates a new BufferedClient publishing events via cl.
+// If maxBatchSize is <= 0, batches are published by flushInterval only.
+// If flushInterval is <= 0, batches are published by size or Flush only.
+func NewBufferedClient(
+	cl *AsyncClient,
+	maxBatchSize int,
+	flushInterval time.Duration,
+	cb BufferedSendCallback,
+) *BufferedClient {
+	return &BufferedClient{
+		cl:            cl,
+		cb:            cb,
+		maxBatchSize:  maxBatchSize,
+		flushInterval: flushInterval,
+	}
+}
+
+// Add adds a single event to the current batch. If the batch is full, the
+// batch is published. Add blocks if the maximum number of in-flight batches
+// of the AsyncClient has been reached. Returns an error if publishing
+// failed or ErrClientClosed if the client has been closed.
+func (c *BufferedClient) Add(event interface{}) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClientClosed
+	}
+	c.events = append(c.events, event)
+	if c.maxBatchSize > 0 && len(c.events) >= c.maxBatchSize {
+		events := c.take()
+		c.mu.Unlock()
+		return c.send(events)
+	}
+	if len(c.events) == 1 && c.flushInterval > 0 {
+		c.startTimer()
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+// Flush publishes the current batch, if not empty.
+func (c *BufferedClient) Flush() error {
+	c.mu.Lock()
+	events := c.take()
+	c.mu.Unlock()
+	return c.send(events)
+}
+
+// Close publishes the current batch and closes the underlying AsyncClient,
+// once all batches being published concurrently have been passed to the
+// AsyncClient. See AsyncClient.Close for details.
+func (c *BufferedClient) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	events := c.take()
+	c.mu.Unlock()
+
+	err := c.send(events)
+	c.sending.Wait()
+	if cerr := c.cl.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// startTimer starts the flush timer. Must be called with c.mu held.
+func (c *BufferedClient) startTimer() {
+	var t *time.Timer
+	t = time.AfterFunc(c.flushInterval, func() {
+		c.mu.Lock()
+		// ignore timer if batch has been flushed concurrently
+		if c.timer != t {
+			c.mu.Unlock()
+			return
+		}
+		events := c.take()
+		c.mu.Unlock()
+
+		_ = c.send(events) // error is reported to callback
+	})
+	c.timer = t
+}
+
+// take removes the current batch from the buffer and stops the flush timer.
+// Must be called with c.mu held. The batch is published via send, after
+// c.mu has been released, such that Add does not block while the AsyncClient
+// applies backpressure.
+func (c *BufferedClient) take() []interface{} {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	events := c.events
+	c.events = nil
+	if len(events) > 0 {
+		c.sending.Add(1)
+	}
+	return events
+}
+
+func (c *BufferedClient) send(events []interface{}) error {
+	if len(events) == 0 {
+		return nil
+	}
+	defer c.sending.Done()
+	return c.cl.Send(func(seq uint32, err error) {
+		if c.cb != nil {
+			c.cb(events, seq, err)
+		}
+	}, events)
+}
@@ -0,0 +1,67 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v2
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBufferedClientAddFromCallback(t *testing.T) {
+	s := newTestServer(t)
+	s.SetAutoACK(true)
+
+	cl, err := AsyncDialWith(s.Dial, "", 1, Timeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every batch published by the test adds a follow-up event from its
+	// callback, while the test keeps publishing batches with the in-flight
+	// limit being reached
+	var c *BufferedClient
+	c = NewBufferedClient(cl, 0, 10*time.Millisecond, func(events []interface{}, seq uint32, err error) {
+		if err != nil {
+			return // in-flight batches are cancelled on Close
+		}
+		for _, event := range events {
+			if event == "event" {
+				c.Add("follow-up")
+			}
+		}
+	})
+	defer c.Close()
+
+	const count = 20
+	for i := 0; i < count; i++ {
+		if err := c.Add("event"); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.Events()) < 2*count {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %v events, got %v", 2*count, len(s.Events()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
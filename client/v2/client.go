@@ -18,16 +18,18 @@
 package v2
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"time"
+	"unicode/utf8"
 
-	"github.com/klauspost/compress/zlib"
-
+	"github.com/elastic/go-lumber/log"
 	protocol "github.com/elastic/go-lumber/protocol/v2"
 )
 
@@ -36,14 +38,23 @@ import (
 type Client struct {
 	conn net.Conn
 	wb   *bytes.Buffer
+	pb   *bytes.Buffer // uncompressed payload buffer
+	sw   *bufio.Writer // streaming writer
 
 	opts options
+
+	// events of last batch, and indices of events sent if events have been
+	// dropped due to SkipEncodeErrors or MaxEventBytes
+	total int
+	sent  []int
 }
 
 var (
 	codeWindowSize    = []byte{protocol.CodeVersion, protocol.CodeWindowSize}
 	codeCompressed    = []byte{protocol.CodeVersion, protocol.CodeCompressed}
 	codeJSONDataFrame = []byte{protocol.CodeVersion, protocol.CodeJSONDataFrame}
+	codeMetadata      = []byte{protocol.CodeVersion, protocol.CodeMetadata}
+	codeEncrypted     = []byte{protocol.CodeVersion, protocol.CodeEncrypted}
 
 	empty4 = []byte{0, 0, 0, 0}
 )
@@ -52,6 +63,10 @@ var (
 	// ErrProtocolError is returned if an protocol error was detected in the
 	// conversation with lumberjack server.
 	ErrProtocolError = errors.New("lumberjack protocol error")
+
+	// ErrEventTooLarge is returned if an event exceeds MaxEventBytes, using
+	// the OversizeError policy.
+	ErrEventTooLarge = errors.New("event exceeds max event bytes")
 )
 
 // NewWithConn create a new lumberjack client with an existing and active
@@ -61,11 +76,51 @@ func NewWithConn(c net.Conn, opts ...Option) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	if err := setSocketOptions(c, o); err != nil {
+		return nil, err
+	}
+
+	cl := newClient(c, o)
+	if err := cl.sendConnectMeta(); err != nil {
+		return nil, err
+	}
+	return cl, nil
+}
+
+func newClient(c net.Conn, o options) *Client {
 	return &Client{
 		conn: c,
 		wb:   bytes.NewBuffer(nil),
+		pb:   bytes.NewBuffer(nil),
 		opts: o,
-	}, nil
+	}
+}
+
+// setSocketOptions applies the configured socket options if c is a TCP
+// connection.
+func setSocketOptions(c net.Conn, o options) error {
+	tcp, ok := c.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	if o.sndBuf > 0 {
+		if err := tcp.SetWriteBuffer(o.sndBuf); err != nil {
+			return err
+		}
+	}
+	if o.rcvBuf > 0 {
+		if err := tcp.SetReadBuffer(o.rcvBuf); err != nil {
+			return err
+		}
+	}
+	if o.tcpUserTimeout > 0 {
+		if err := setTCPUserTimeout(tcp, o.tcpUserTimeout); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Dial connects to the lumberjack server and returns new Client.
@@ -87,17 +142,64 @@ func DialWith(
 	address string,
 	opts ...Option,
 ) (*Client, error) {
-	c, err := dial("tcp", address)
+	o, err := applyOptions(opts)
 	if err != nil {
 		return nil, err
 	}
 
-	client, err := NewWithConn(c, opts...)
+	c, err := dial("tcp", address)
 	if err != nil {
+		return nil, err
+	}
+
+	if err := setSocketOptions(c, o); err != nil {
+		_ = c.Close() // ignore error
+		return nil, err
+	}
+
+	if o.tls != nil {
+		tc, err := tlsHandshake(c, address, o)
+		if err != nil {
+			_ = c.Close() // ignore error
+			return nil, err
+		}
+		c = tc
+	}
+
+	cl := newClient(c, o)
+	if err := cl.sendConnectMeta(); err != nil {
 		_ = c.Close() // ignore error
 		return nil, err
 	}
-	return client, nil
+	return cl, nil
+}
+
+// tlsHandshake wraps c in a TLS client connection, running the handshake
+// within the configured timeout.
+func tlsHandshake(c net.Conn, address string, o options) (*tls.Conn, error) {
+	config := o.tls
+	if config.ServerName == "" && !config.InsecureSkipVerify {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	tc := tls.Client(c, config)
+	if o.timeout > 0 {
+		if err := tc.SetDeadline(time.Now().Add(o.timeout)); err != nil {
+			return nil, err
+		}
+	}
+	if err := tc.Handshake(); err != nil {
+		return nil, err
+	}
+	if err := tc.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return tc, nil
 }
 
 // Close closes underlying network connection
@@ -106,55 +208,99 @@ func (c *Client) Close() error {
 }
 
 // Send attempts to JSON-encode and send all events without waiting for ACK.
+// Events can be of any type supported by the configured JSON encoder. Using
+// the default encoder, structs are serialized respecting their `json` tags.
 // Returns error if sending or serialization fails.
 func (c *Client) Send(data []interface{}) error {
+	return c.SendWithMeta(nil, data)
+}
+
+// SendWithMeta sends a batch of events like Send, plus a metadata frame
+// holding batch level fields. Servers supporting metadata frames make the
+// metadata available via lj.Batch.Meta, such that fields constant across the
+// batch do not need to be added to every event. The metadata frame is omitted
+// if meta is nil.
+// Note: Metadata frames are an extension to the lumberjack protocol. Servers
+// not supporting metadata frames close the connection.
+func (c *Client) SendWithMeta(meta map[string]interface{}, data []interface{}) error {
+	c.total, c.sent = len(data), nil
+	if c.opts.skipEncodeErrors || c.opts.maxEventBytes > 0 {
+		var err error
+		if data, err = c.encodeAll(data); err != nil {
+			return err
+		}
+	}
 	if len(data) == 0 {
 		return nil
 	}
+	if c.opts.streamBuf > 0 {
+		return c.sendStream(meta, data)
+	}
 
 	// 1. create window message
 	c.wb.Reset()
 	_, _ = c.wb.Write(codeWindowSize)
 	writeUint32(c.wb, uint32(len(data)))
+	if err := c.serializeMeta(c.wb, meta); err != nil {
+		return err
+	}
 
 	// 2. serialize data (payload)
-	if c.opts.compressLvl > 0 {
-		// Compressed Data Frame:
-		// version: uint8 = '2'
-		// code: uint8 = 'C'
-		// payloadSz: uint32
-		// payload: compressed payload
-
-		_, _ = c.wb.Write(codeCompressed) // write compressed header
+	switch {
+	case c.opts.compressLvl > 0 && c.opts.encrypter == nil &&
+		(c.opts.compressThreshold > 0 || c.opts.adaptiveCompression):
+		// serialize uncompressed payload first, so to decide on compression by
+		// payload size
+		c.pb.Reset()
+		if err := c.serialize(c.pb, data); err != nil {
+			return err
+		}
 
-		offSz := c.wb.Len()
-		_, _ = c.wb.Write(empty4)
-		offPayload := c.wb.Len()
+		if c.pb.Len() < c.opts.compressThreshold {
+			_, _ = c.wb.Write(c.pb.Bytes())
+			break
+		}
 
-		// compress payload
-		w, err := zlib.NewWriterLevel(c.wb, c.opts.compressLvl)
+		off := c.wb.Len()
+		compressed, err := c.compress(func(w io.Writer) error {
+			_, err := w.Write(c.pb.Bytes())
+			return err
+		})
 		if err != nil {
 			return err
 		}
 
-		if err := c.serialize(w, data); err != nil {
-			return err
+		if c.opts.adaptiveCompression && c.wb.Len()-off >= c.pb.Len() {
+			// compression does not pay off, send uncompressed payload instead
+			c.wb.Truncate(off)
+			_, _ = c.wb.Write(c.pb.Bytes())
+			break
 		}
-
-		if err := w.Close(); err != nil {
+		c.reportCompression(c.pb.Len(), compressed)
+
+	case c.opts.compressLvl > 0:
+		var cw countWriter
+		compressed, err := c.compress(func(w io.Writer) error {
+			cw.w = w
+			return c.serialize(&cw, data)
+		})
+		if err != nil {
 			return err
 		}
+		c.reportCompression(cw.n, compressed)
 
-		// write compress header
-		payloadSz := c.wb.Len() - offPayload
-		binary.BigEndian.PutUint32(c.wb.Bytes()[offSz:], uint32(payloadSz))
-	} else {
+	default:
 		if err := c.serialize(c.wb, data); err != nil {
 			return err
 		}
 	}
 
 	// 3. send buffer
+	return c.flushBuffer()
+}
+
+// flushBuffer writes the write buffer to the connection.
+func (c *Client) flushBuffer() error {
 	if err := c.setWriteDeadline(); err != nil {
 		return err
 	}
@@ -171,6 +317,217 @@ func (c *Client) Send(data []interface{}) error {
 	return nil
 }
 
+// sendConnectMeta sends the connection metadata configured via ConnectMeta
+// as metadata frame outside of a window.
+func (c *Client) sendConnectMeta() error {
+	if c.opts.connectMeta == nil {
+		return nil
+	}
+
+	c.wb.Reset()
+	if err := c.serializeMeta(c.wb, c.opts.connectMeta); err != nil {
+		return err
+	}
+	return c.flushBuffer()
+}
+
+// sendStream encodes and writes the batch to the connection using a bounded
+// buffer. If compression is enabled, events are split into multiple compressed
+// frames, each holding up to streamBuf bytes of uncompressed payload.
+func (c *Client) sendStream(meta map[string]interface{}, data []interface{}) error {
+	if err := c.setWriteDeadline(); err != nil {
+		return err
+	}
+
+	// encode metadata before writing anything, such that an encoding error
+	// does not leave a partial window on the connection
+	var metaBuf bytes.Buffer
+	if err := c.serializeMeta(&metaBuf, meta); err != nil {
+		return err
+	}
+
+	if c.sw == nil {
+		c.sw = bufio.NewWriterSize(c.conn, c.opts.streamBuf)
+	}
+
+	if err := c.writeStream(c.sw, metaBuf.Bytes(), data); err != nil {
+		// Parts of the window might already have been written or are still
+		// buffered. The connection can not be recovered, as the server would
+		// interpret the following bytes as part of the window.
+		_ = c.conn.Close()
+		c.sw = nil
+		return err
+	}
+	return nil
+}
+
+func (c *Client) writeStream(w *bufio.Writer, meta []byte, data []interface{}) error {
+	_, _ = w.Write(codeWindowSize)
+	writeUint32(w, uint32(len(data)))
+	_, _ = w.Write(meta)
+
+	if c.opts.compressLvl == 0 {
+		if err := c.serialize(w, data); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+
+	var uncompressed, compressed int
+	for i := 0; i < len(data); {
+		c.wb.Reset()
+		var cw countWriter
+		n, err := c.compress(func(out io.Writer) error {
+			cw.w = out
+			for written := 0; i < len(data) && written < c.opts.streamBuf; i++ {
+				n, err := c.serializeEvent(&cw, uint32(i)+1, data[i])
+				if err != nil {
+					return err
+				}
+				written += n
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		uncompressed += cw.n
+		compressed += n
+
+		if _, err := w.Write(c.wb.Bytes()); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	c.reportCompression(uncompressed, compressed)
+	return nil
+}
+
+// Skipped returns the number of events dropped from the last batch due to
+// encoding errors or exceeding the event size limit. See SkipEncodeErrors and
+// MaxEventBytes.
+func (c *Client) Skipped() int {
+	if c.sent == nil {
+		return 0
+	}
+	return c.total - len(c.sent)
+}
+
+// preEncoded holds an event already encoded by encodeAll.
+type preEncoded []byte
+
+// encodeAll encodes all events, returning the encoded events only. Events
+// failing to be encoded or exceeding the event size limit are logged and
+// dropped, if configured.
+func (c *Client) encodeAll(data []interface{}) ([]interface{}, error) {
+	var sent []int
+	encoded := make([]interface{}, 0, len(data))
+	for i, event := range data {
+		b, err := c.opts.encoder(event)
+		if err != nil {
+			if !c.opts.skipEncodeErrors {
+				return nil, err
+			}
+			log.Printf("Dropping event %v failing to be encoded: %v", i, err)
+			continue
+		}
+
+		if max := c.opts.maxEventBytes; max > 0 && len(b) > max {
+			if c.opts.oversize == OversizeError {
+				return nil, ErrEventTooLarge
+			}
+			if c.opts.oversize == OversizeTruncate {
+				b = c.truncate(event, b)
+			} else {
+				b = nil
+			}
+			if b == nil {
+				log.Printf("Dropping event %v exceeding max event bytes %v", i, max)
+				continue
+			}
+		}
+
+		encoded = append(encoded, preEncoded(b))
+		sent = append(sent, i)
+	}
+
+	if len(sent) < len(data) {
+		c.sent = sent
+		if c.sent == nil {
+			c.sent = []int{}
+		}
+	}
+	return encoded, nil
+}
+
+// truncate shortens the configured truncate field of event until the
+// encoded event fits into maxEventBytes. Returns nil if the event can not be
+// truncated to fit. The event itself is not modified.
+func (c *Client) truncate(event interface{}, encoded []byte) []byte {
+	m, ok := event.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	field := c.opts.truncateField
+	str, ok := m[field].(string)
+	if !ok {
+		return nil
+	}
+
+	tmp := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		tmp[k] = v
+	}
+
+	for over := len(encoded) - c.opts.maxEventBytes; over > 0; over = len(encoded) - c.opts.maxEventBytes {
+		if str == "" {
+			return nil
+		}
+
+		// cut at rune boundary
+		n := len(str) - over
+		if n < 0 {
+			n = 0
+		}
+		for n > 0 && !utf8.RuneStart(str[n]) {
+			n--
+		}
+		str = str[:n]
+		tmp[field] = str
+
+		var err error
+		if encoded, err = c.opts.encoder(tmp); err != nil {
+			return nil
+		}
+	}
+	return encoded
+}
+
+// lastWindow returns the window size of the last batch sent and a function
+// translating ACKed sequence numbers to the number of events processed from
+// the original batch, accounting for events dropped by SkipEncodeErrors or
+// MaxEventBytes.
+func (c *Client) lastWindow() (uint32, func(uint32) uint32) {
+	if c.sent == nil {
+		return uint32(c.total), func(seq uint32) uint32 { return seq }
+	}
+
+	total, sent := uint32(c.total), c.sent
+	return uint32(len(sent)), func(seq uint32) uint32 {
+		switch {
+		case seq >= uint32(len(sent)):
+			return total
+		case seq == 0:
+			return 0
+		default:
+			return uint32(sent[seq-1]) + 1
+		}
+	}
+}
+
 // ReceiveACK awaits and reads next ACK response or error. Note: Server might
 // send partial ACK, in which case client must continue reading ACKs until last send
 // window size is matched. Use AwaitACK when waiting for a known sequence number.
@@ -200,6 +557,12 @@ func (c *Client) ReceiveACK() (uint32, error) {
 }
 
 // AwaitACK waits for count elements being ACKed. Returns last known ACK on error.
+//
+// ACK sequence numbers are relative to the window being ACKed, starting at 1
+// for every window. AwaitACK waits for a single window, such that an ACK
+// exceeding count is reported as invalid sequence number. AsyncClient applies
+// ACKs exceeding the window to the windows sent next, for servers coalescing
+// the ACKs of multiple windows.
 func (c *Client) AwaitACK(count uint32) (uint32, error) {
 	var ackSeq uint32
 	var err error
@@ -219,25 +582,129 @@ func (c *Client) AwaitACK(count uint32) (uint32, error) {
 	return ackSeq, nil
 }
 
+// awaitCoalescedACK waits for count elements being ACKed, starting with
+// acked elements being ACKed already. ACKs exceeding count acknowledge the
+// windows sent next. The number of elements ACKed beyond count is returned
+// as excess.
+func (c *Client) awaitCoalescedACK(count, acked uint32) (seq, excess uint32, err error) {
+	seq = acked
+	for seq < count {
+		if seq, err = c.ReceiveACK(); err != nil {
+			return seq, 0, err
+		}
+	}
+	return count, seq - count, nil
+}
+
+// compress writes a compressed data frame to the write buffer, returning the
+// size of the compressed payload.
+func (c *Client) compress(payload func(io.Writer) error) (int, error) {
+	// Compressed Data Frame:
+	// version: uint8 = '2'
+	// code: uint8 = 'C'
+	// payloadSz: uint32
+	// payload: compressed payload
+	//
+	// If payload encryption is enabled, the code is 'E' and the payload holds
+	// the encrypted compressed payload.
+
+	offFrame := c.wb.Len()
+	_, _ = c.wb.Write(codeCompressed) // write compressed header
+
+	offSz := c.wb.Len()
+	_, _ = c.wb.Write(empty4)
+	offPayload := c.wb.Len()
+
+	// compress payload
+	w, err := getZlibWriter(c.wb, c.opts.compressLvl)
+	if err != nil {
+		return 0, err
+	}
+	defer putZlibWriter(w, c.opts.compressLvl)
+
+	if err := payload(w); err != nil {
+		return 0, err
+	}
+
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+
+	payloadSz := c.wb.Len() - offPayload
+	if c.opts.encrypter != nil {
+		encrypted, err := c.opts.encrypter(c.wb.Bytes()[offPayload:])
+		if err != nil {
+			return 0, err
+		}
+		c.wb.Truncate(offPayload)
+		_, _ = c.wb.Write(encrypted)
+		copy(c.wb.Bytes()[offFrame:], codeEncrypted)
+	}
+
+	// write compress header
+	binary.BigEndian.PutUint32(c.wb.Bytes()[offSz:], uint32(c.wb.Len()-offPayload))
+	return payloadSz, nil
+}
+
+func (c *Client) reportCompression(uncompressed, compressed int) {
+	if c.opts.compressStats != nil {
+		c.opts.compressStats(uncompressed, compressed)
+	}
+}
+
 func (c *Client) serialize(out io.Writer, data []interface{}) error {
 	for i, d := range data {
-		b, err := c.opts.encoder(d)
-		if err != nil {
+		if _, err := c.serializeEvent(out, uint32(i)+1, d); err != nil {
 			return err
 		}
+	}
+	return nil
+}
+
+// serializeEvent writes a single event as JSON data frame, returning the
+// number of payload bytes written.
+func (c *Client) serializeEvent(out io.Writer, seq uint32, event interface{}) (int, error) {
+	b, ok := event.(preEncoded)
+	if !ok {
+		var err error
+		if b, err = c.opts.encoder(event); err != nil {
+			return 0, err
+		}
+	}
 
-		// Write JSON Data Frame:
-		// version: uint8 = '2'
-		// code: uint8 = 'J'
-		// seq: uint32
-		// payloadLen (bytes): uint32
-		// payload: JSON document
+	// Write JSON Data Frame:
+	// version: uint8 = '2'
+	// code: uint8 = 'J'
+	// seq: uint32
+	// payloadLen (bytes): uint32
+	// payload: JSON document
+
+	_, _ = out.Write(codeJSONDataFrame)
+	writeUint32(out, seq)
+	writeUint32(out, uint32(len(b)))
+	_, _ = out.Write(b)
+	return len(b), nil
+}
+
+func (c *Client) serializeMeta(out io.Writer, meta map[string]interface{}) error {
+	if meta == nil {
+		return nil
+	}
 
-		_, _ = out.Write(codeJSONDataFrame)
-		writeUint32(out, uint32(i)+1)
-		writeUint32(out, uint32(len(b)))
-		_, _ = out.Write(b)
+	b, err := c.opts.encoder(meta)
+	if err != nil {
+		return err
 	}
+
+	// Write Metadata Frame:
+	// version: uint8 = '2'
+	// code: uint8 = 'M'
+	// payloadLen (bytes): uint32
+	// payload: JSON object
+
+	_, _ = out.Write(codeMetadata)
+	writeUint32(out, uint32(len(b)))
+	_, _ = out.Write(b)
 	return nil
 }
 
@@ -249,6 +716,20 @@ func (c *Client) setReadDeadline() error {
 	return c.conn.SetReadDeadline(time.Now().Add(c.opts.timeout))
 }
 
+// countWriter counts the number of bytes written to the underlying writer.
+type countWriter struct {
+	w io.Writer
+	n int
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += n
+	return n, err
+}
+
 func writeUint32(out io.Writer, v uint32) {
-	_ = binary.Write(out, binary.BigEndian, v)
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	_, _ = out.Write(buf[:])
 }
@@ -0,0 +1,395 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v2
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-lumber/lumbertest"
+	"github.com/elastic/go-lumber/server"
+)
+
+func newTestServer(t *testing.T, opts ...server.Option) *lumbertest.Server {
+	t.Helper()
+	s, err := lumbertest.NewServer(opts...)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestStreamEncodeErrorClosesConnection(t *testing.T) {
+	s := newTestServer(t)
+	s.SetAutoACK(true)
+
+	errEncode := errors.New("encode failure")
+	encoder := func(v interface{}) ([]byte, error) {
+		if v == "fail" {
+			return nil, errEncode
+		}
+		return json.Marshal(v)
+	}
+
+	for _, level := range []int{0, 3} {
+		c, err := SyncDialWith(s.Dial, "", JSONEncoder(encoder),
+			StreamBufferSize(4096), CompressionLevel(level), Timeout(time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = c.Send([]interface{}{"ok", "fail", "ok"})
+		if err != errEncode {
+			t.Fatalf("level %v: expected encode error, got %v", level, err)
+		}
+
+		// the connection holding the partial window must have been closed
+		if _, err := c.Send([]interface{}{"ok"}); err != io.ErrClosedPipe {
+			t.Fatalf("level %v: expected closed connection, got %v", level, err)
+		}
+		c.Close()
+	}
+
+	if events := s.Events(); len(events) != 0 {
+		t.Errorf("expected no events, got %v", events)
+	}
+}
+
+func TestSendStructEvents(t *testing.T) {
+	type host struct {
+		Name string `json:"name"`
+	}
+	type event struct {
+		Message string            `json:"message"`
+		Count   int               `json:"count"`
+		Host    host              `json:"host"`
+		Tags    map[string]string `json:"tags,omitempty"`
+		Secret  string            `json:"-"`
+	}
+
+	for _, level := range []int{0, 3} {
+		s := newTestServer(t)
+		s.SetAutoACK(true)
+
+		c, err := SyncDialWith(s.Dial, "", CompressionLevel(level), Timeout(time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		events := []interface{}{
+			event{Message: "hello", Count: 1, Host: host{Name: "a"}, Secret: "x"},
+			&event{Message: "world", Count: 2, Host: host{Name: "b"}},
+		}
+		if n, err := c.Send(events); err != nil || n != len(events) {
+			t.Fatalf("level %v: send failed: n=%v, err=%v", level, n, err)
+		}
+		c.Close()
+
+		expected := []interface{}{
+			map[string]interface{}{
+				"message": "hello",
+				"count":   float64(1),
+				"host":    map[string]interface{}{"name": "a"},
+			},
+			map[string]interface{}{
+				"message": "world",
+				"count":   float64(2),
+				"host":    map[string]interface{}{"name": "b"},
+			},
+		}
+		if got := s.Events(); !reflect.DeepEqual(got, expected) {
+			t.Errorf("level %v: expected events %v, got %v", level, expected, got)
+		}
+	}
+}
+
+func TestSyncACKPerWindow(t *testing.T) {
+	s := newTestServer(t)
+	s.SetAutoACK(true)
+
+	c, err := SyncDialWith(s.Dial, "", Timeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// sequence numbers restart with every window
+	for _, size := range []int{3, 2, 1} {
+		events := make([]interface{}, size)
+		for i := range events {
+			events[i] = map[string]interface{}{"i": i}
+		}
+
+		n, seq, err := c.SendSeq(nil, events)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != size || seq != uint32(size) {
+			t.Errorf("expected n=%v and seq=%v, got n=%v and seq=%v", size, size, n, seq)
+		}
+	}
+}
+
+func TestSyncACKExceedingWindow(t *testing.T) {
+	// The server ACKs one event more than sent in the window. With a single
+	// window in flight, there is no window the excess ACK could apply to.
+	encoder := func(seq uint32) []byte {
+		ack := []byte{'2', 'A', 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(ack[2:], seq+1)
+		return ack
+	}
+	s := newTestServer(t, server.ACKEncoder(encoder))
+	s.SetAutoACK(true)
+
+	c, err := SyncDialWith(s.Dial, "", Timeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_, err = c.Send([]interface{}{"a", "b"})
+	if err == nil || !strings.Contains(err.Error(), "invalid sequence number") {
+		t.Fatalf("expected invalid sequence number error, got %v", err)
+	}
+}
+
+func TestAsyncCallbacksInOrder(t *testing.T) {
+	s := newTestServer(t)
+	s.SetAutoACK(true)
+
+	c, err := AsyncDialWith(s.Dial, "", 4, Timeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type result struct {
+		batch int
+		seq   uint32
+	}
+
+	var (
+		mu      sync.Mutex
+		results []result
+		wg      sync.WaitGroup
+	)
+
+	sizes := []int{1, 4, 2, 3, 5, 1}
+	for i, size := range sizes {
+		i := i
+		events := make([]interface{}, size)
+		for j := range events {
+			events[j] = map[string]interface{}{"batch": i}
+		}
+
+		wg.Add(1)
+		err := c.Send(func(seq uint32, err error) {
+			defer wg.Done()
+			if err != nil {
+				t.Errorf("batch %v failed: %v", i, err)
+			}
+			mu.Lock()
+			results = append(results, result{i, seq})
+			mu.Unlock()
+		}, events)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	if len(results) != len(sizes) {
+		t.Fatalf("expected %v callbacks, got %v", len(sizes), len(results))
+	}
+	for i, r := range results {
+		if r.batch != i {
+			t.Fatalf("expected callback of batch %v, got batch %v", i, r.batch)
+		}
+		if r.seq != uint32(sizes[i]) {
+			t.Errorf("batch %v: expected seq %v, got %v", i, sizes[i], r.seq)
+		}
+	}
+}
+
+// readWindows reads count windows of uncompressed JSON frames from conn,
+// returning the number of events per window.
+func readWindows(conn net.Conn, count int) ([]int, error) {
+	in := bufio.NewReader(conn)
+	var windows []int
+	for len(windows) < count {
+		var hdr [2]byte
+		if _, err := io.ReadFull(in, hdr[:]); err != nil {
+			return nil, err
+		}
+
+		switch hdr[1] {
+		case 'W':
+			var buf [4]byte
+			if _, err := io.ReadFull(in, buf[:]); err != nil {
+				return nil, err
+			}
+			n := int(binary.BigEndian.Uint32(buf[:]))
+			for i := 0; i < n; i++ {
+				var frame [10]byte
+				if _, err := io.ReadFull(in, frame[:]); err != nil {
+					return nil, err
+				}
+				size := binary.BigEndian.Uint32(frame[6:])
+				if _, err := in.Discard(int(size)); err != nil {
+					return nil, err
+				}
+			}
+			windows = append(windows, n)
+		default:
+			return nil, fmt.Errorf("unexpected frame %q", hdr)
+		}
+	}
+	return windows, nil
+}
+
+func TestAsyncCoalescedACK(t *testing.T) {
+	sizes := []int{2, 3, 1}
+
+	tests := map[string][]uint32{
+		"single ACK for all windows": {6},
+		"ACK ending within window":   {3, 3, 1},
+		"ACK per window":             {2, 3, 1},
+	}
+
+	for name, acks := range tests {
+		t.Run(name, func(t *testing.T) {
+			testAsyncACKs(t, sizes, acks)
+		})
+	}
+}
+
+// testAsyncACKs sends windows of the given sizes using an AsyncClient. Once
+// all windows have been received, the server sends acks. All callbacks must
+// be called in order, with the window being ACKed completely.
+func testAsyncACKs(t *testing.T, sizes []int, acks []uint32) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	c, err := NewAsyncClientWithConn(client, len(sizes), CompressionLevel(0), Timeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		if _, err := readWindows(server, len(sizes)); err != nil {
+			serverErr <- err
+			return
+		}
+
+		for _, seq := range acks {
+			ack := []byte{'2', 'A', 0, 0, 0, 0}
+			binary.BigEndian.PutUint32(ack[2:], seq)
+			if _, err := server.Write(ack); err != nil {
+				serverErr <- err
+				return
+			}
+		}
+		serverErr <- nil
+	}()
+
+	type result struct {
+		batch int
+		seq   uint32
+	}
+	results := make(chan result, len(sizes))
+	for i, size := range sizes {
+		i := i
+		events := make([]interface{}, size)
+		for j := range events {
+			events[j] = map[string]interface{}{"batch": i}
+		}
+
+		err := c.Send(func(seq uint32, err error) {
+			if err != nil {
+				t.Errorf("batch %v failed: %v", i, err)
+			}
+			results <- result{i, seq}
+		}, events)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := <-serverErr; err != nil {
+		t.Fatal(err)
+	}
+	for i, size := range sizes {
+		select {
+		case r := <-results:
+			if r.batch != i || r.seq != uint32(size) {
+				t.Errorf("expected batch %v with seq %v, got batch %v with seq %v",
+					i, size, r.batch, r.seq)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for callback of batch %v", i)
+		}
+	}
+}
+
+func BenchmarkSend(b *testing.B) {
+	events := make([]interface{}, 100)
+	for i := range events {
+		events[i] = map[string]interface{}{
+			"message": "the quick brown fox jumps over the lazy dog",
+			"count":   i,
+		}
+	}
+
+	for _, level := range []int{0, 3} {
+		b.Run(fmt.Sprintf("level=%v", level), func(b *testing.B) {
+			s, err := lumbertest.NewServer()
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer s.Close()
+			s.SetAutoACK(true)
+
+			c, err := SyncDialWith(s.Dial, "", CompressionLevel(level))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer c.Close()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.Send(events); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v2
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// CoalescingClient merges events of successive Send calls into larger
+// windows published via a SyncClient. A window is published once maxEvents
+// events have been accumulated or maxDelay has passed since the first call
+// of the window. Send blocks until the window holding the call's events has
+// been ACKed. Windows are published in order by a single worker, such that
+// the SyncClient must not be used concurrently by other callers.
+type CoalescingClient struct {
+	cl *SyncClient
+
+	maxEvents int
+	maxDelay  time.Duration
+
+	mu     sync.Mutex
+	events []interface{}
+	calls  []*coalescedCall
+	timer  *time.Timer
+	queue  []coalescedWindow
+	closed bool
+
+	wake chan struct{}
+	done chan struct{}
+}
+
+type coalescedWindow struct {
+	events []interface{}
+	calls  []*coalescedCall
+}
+
+type coalescedCall struct {
+	offset, count int
+
+	done  chan struct{}
+	acked int
+	err   error
+}
+
+// ErrClientClosed is returned by CoalescingClient.Send after Close.
+var ErrClientClosed = errors.New("client closed")
+
+// Coalesce creates a new CoalescingClient publishing via cl. If maxEvents is
+// <= 0, windows are published by maxDelay only. If maxDelay is <= 0, the
+// accumulated events are published right away, such that only calls made
+// while a window is being published are coalesced.
+func Coalesce(cl *SyncClient, maxEvents int, maxDelay time.Duration) *CoalescingClient {
+	c := &CoalescingClient{
+		cl:        cl,
+		maxEvents: maxEvents,
+		maxDelay:  maxDelay,
+		wake:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+// Send adds data to the current window and waits for the window to be
+// ACKed. Returns the number of events of data being ACKed and the error of
+// publishing the window, if any.
+func (c *CoalescingClient) Send(data []interface{}) (int, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return 0, ErrClientClosed
+	}
+
+	call := &coalescedCall{
+		offset: len(c.events),
+		count:  len(data),
+		done:   make(chan struct{}),
+	}
+	c.events = append(c.events, data...)
+	c.calls = append(c.calls, call)
+	switch {
+	case c.maxDelay <= 0 || (c.maxEvents > 0 && len(c.events) >= c.maxEvents):
+		c.flush()
+	case len(c.calls) == 1:
+		c.startTimer()
+	}
+	c.mu.Unlock()
+
+	<-call.done
+	return call.acked, call.err
+}
+
+// Close publishes the current window, waits for all windows to be ACKed and
+// closes the underlying SyncClient.
+func (c *CoalescingClient) Close() error {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		c.flush()
+		close(c.wake)
+	}
+	c.mu.Unlock()
+
+	<-c.done
+	return c.cl.Close()
+}
+
+// startTimer starts the flush timer. Must be called with c.mu held.
+func (c *CoalescingClient) startTimer() {
+	var t *time.Timer
+	t = time.AfterFunc(c.maxDelay, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		// ignore timer if window has been flushed concurrently
+		if c.timer == t {
+			c.flush()
+		}
+	})
+	c.timer = t
+}
+
+// flush queues the current window for publishing. Must be called with c.mu
+// held.
+func (c *CoalescingClient) flush() {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if len(c.events) == 0 {
+		return
+	}
+
+	c.queue = append(c.queue, coalescedWindow{events: c.events, calls: c.calls})
+	c.events, c.calls = nil, nil
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run publishes queued windows in order, until the client is closed and all
+// windows have been published.
+func (c *CoalescingClient) run() {
+	defer close(c.done)
+
+	for range c.wake {
+		for {
+			c.mu.Lock()
+			if len(c.queue) == 0 {
+				c.mu.Unlock()
+				break
+			}
+			w := c.queue[0]
+			c.queue = c.queue[1:]
+			c.mu.Unlock()
+
+			c.publish(w)
+		}
+	}
+}
+
+func (c *CoalescingClient) publish(w coalescedWindow) {
+	n, err := c.cl.Send(w.events)
+	for _, call := range w.calls {
+		acked := n - call.offset
+		if acked < 0 {
+			acked = 0
+		} else if acked > call.count {
+			acked = call.count
+		}
+
+		call.acked, call.err = acked, err
+		close(call.done)
+	}
+}
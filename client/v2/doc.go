@@ -20,4 +20,6 @@
 // This package provides the low level `Client` handling the wire-format only,
 // plus `SyncClient` and AsyncClient. SyncClient and AsyncClient do provide
 // protocol compliant communication and error handling with lumberjack server.
+// LazyClient wraps AsyncClient, connecting to the server in the background.
+// BufferedClient wraps AsyncClient, accumulating single events into batches.
 package v2
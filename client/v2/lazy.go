@@ -0,0 +1,208 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v2
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-lumber/log"
+)
+
+// LazyClient publishes events asynchronously like AsyncClient, but connects to
+// the lumberjack endpoint in the background. Batches sent while the connection
+// is being established are buffered up to a configurable limit and published
+// in order once the connection is ready. If RetryBackoff is configured,
+// failed connection attempts are retried until the client is closed.
+type LazyClient struct {
+	mu      sync.Mutex
+	cl      *AsyncClient
+	err     error
+	pending []lazyBatch
+	buffer  int
+	done    chan struct{}
+
+	closeOnce sync.Once
+	closing   chan struct{}
+}
+
+type lazyBatch struct {
+	cb   AsyncSendCallback
+	data []interface{}
+}
+
+// NewLazyClient returns a new LazyClient connecting to the lumberjack server in
+// the background. The inflight argument sets the number of active publish
+// requests. The buffer argument sets the number of batches being buffered
+// while connecting.
+func NewLazyClient(address string, inflight, buffer int, opts ...Option) *LazyClient {
+	return NewLazyClientWith(nil, address, inflight, buffer, opts...)
+}
+
+// NewLazyClientWith returns a new LazyClient using the provided dialer to
+// connect to the lumberjack server in the background. If dial is nil, the
+// default dialer is used.
+func NewLazyClientWith(
+	dial func(network, address string) (net.Conn, error),
+	address string,
+	inflight, buffer int,
+	opts ...Option,
+) *LazyClient {
+	c := &LazyClient{
+		buffer:  buffer,
+		done:    make(chan struct{}),
+		closing: make(chan struct{}),
+	}
+	go c.connect(dial, address, inflight, opts)
+	return c
+}
+
+func (c *LazyClient) connect(
+	dial func(network, address string) (net.Conn, error),
+	address string,
+	inflight int,
+	opts []Option,
+) {
+	var backoff Backoff
+	if o, err := applyOptions(opts); err == nil {
+		backoff = o.backoff
+	}
+
+	var cl *AsyncClient
+	var err error
+	for attempt := 1; ; attempt++ {
+		if dial == nil {
+			cl, err = AsyncDial(address, inflight, opts...)
+		} else {
+			cl, err = AsyncDialWith(dial, address, inflight, opts...)
+		}
+		if err == nil || backoff == nil {
+			break
+		}
+
+		log.Printf("Failed to connect to %v: %v", address, err)
+		if !c.sleep(backoff.Next(attempt)) {
+			break
+		}
+	}
+
+	// Publish buffered batches without holding the lock, such that callbacks
+	// can call Send. Batches buffered in the meantime are published in order,
+	// before the client is marked as connected.
+	for {
+		c.mu.Lock()
+		pending := c.pending
+		c.pending = nil
+		if len(pending) == 0 {
+			c.cl, c.err = cl, err
+			close(c.done)
+			c.mu.Unlock()
+			return
+		}
+		c.mu.Unlock()
+
+		for _, b := range pending {
+			if err != nil {
+				b.cb(0, err)
+				continue
+			}
+			if serr := send(cl, b.cb, b.data); serr != ErrCircuitOpen {
+				err = serr
+			}
+		}
+	}
+}
+
+// send publishes data via cl. The callback is called with the error, if
+// the AsyncClient returns an error without calling the callback.
+func send(cl *AsyncClient, cb AsyncSendCallback, data []interface{}) error {
+	err := cl.Send(cb, data)
+	if err == ErrCircuitOpen {
+		cb(0, err)
+	}
+	return err
+}
+
+// sleep waits for d. Returns false if the client is closed in the meantime.
+func (c *LazyClient) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-c.closing:
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// Wait blocks until the connection attempt has finished. Returns the error
+// encountered while connecting or publishing buffered batches.
+func (c *LazyClient) Wait() error {
+	<-c.done
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Send publishes a new batch of events. If the client is still connecting,
+// the batch is buffered and Send returns immediately. The buffered events
+// must not be modified until the callback has been called. Once the buffer is
+// full, Send blocks until the connection has been established.
+// See AsyncClient.Send for details on the callback. Returns an error if
+// connecting failed. The callback is called with the error on failure.
+func (c *LazyClient) Send(cb AsyncSendCallback, data []interface{}) error {
+	c.mu.Lock()
+	if c.cl == nil && c.err == nil {
+		if len(c.pending) < c.buffer {
+			c.pending = append(c.pending, lazyBatch{cb: cb, data: data})
+			c.mu.Unlock()
+			return nil
+		}
+
+		c.mu.Unlock()
+		<-c.done
+		c.mu.Lock()
+	}
+	cl, err := c.cl, c.err
+	c.mu.Unlock()
+
+	if err != nil {
+		cb(0, err)
+		return err
+	}
+	return send(cl, cb, data)
+}
+
+// Close waits for the connection attempt to finish and closes the client.
+// Batches buffered while connecting are published before the connection is
+// closed. If the client is retrying to connect, retries are stopped and
+// buffered batches fail with the last connection error. See
+// AsyncClient.Close for details.
+func (c *LazyClient) Close() error {
+	c.closeOnce.Do(func() { close(c.closing) })
+	<-c.done
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cl == nil {
+		return nil
+	}
+	return c.cl.Close()
+}
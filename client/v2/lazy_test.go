@@ -0,0 +1,140 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v2
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// blockingDial returns a dialer blocking until release is closed.
+func blockingDial(
+	dial func(network, address string) (net.Conn, error),
+	release chan struct{},
+) func(network, address string) (net.Conn, error) {
+	return func(network, address string) (net.Conn, error) {
+		<-release
+		return dial(network, address)
+	}
+}
+
+func TestLazyClientSendFromCallback(t *testing.T) {
+	s := newTestServer(t)
+	s.SetAutoACK(true)
+
+	release := make(chan struct{})
+	c := NewLazyClientWith(blockingDial(s.Dial, release), "", 1, 4, Timeout(time.Second))
+	defer c.Close()
+
+	// every buffered batch publishes a follow-up batch from its callback
+	done := make(chan int, 8)
+	for i := 0; i < 4; i++ {
+		i := i
+		err := c.Send(func(seq uint32, err error) {
+			if err != nil {
+				t.Errorf("batch %v failed: %v", i, err)
+			}
+			err = c.Send(func(seq uint32, err error) {
+				if err != nil {
+					t.Errorf("follow-up of batch %v failed: %v", i, err)
+				}
+				done <- i
+			}, []interface{}{"follow-up"})
+			if err != nil {
+				t.Errorf("failed to send follow-up of batch %v: %v", i, err)
+			}
+			done <- i
+		}, []interface{}{"buffered"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(release)
+
+	for i := 0; i < 8; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout after %v callbacks", i)
+		}
+	}
+}
+
+func TestLazyClientCallbackOnCircuitOpen(t *testing.T) {
+	s := newTestServer(t)
+	s.SetAutoACK(true)
+
+	breaker := NewBreaker(1, time.Hour)
+	release := make(chan struct{})
+	c := NewLazyClientWith(blockingDial(s.Dial, release), "", 1, 4,
+		Timeout(time.Second), CircuitBreaker(breaker))
+	defer c.Close()
+
+	results := make(chan error, 2)
+	cb := func(seq uint32, err error) { results <- err }
+
+	// buffered batch published once connected
+	if err := c.Send(cb, []interface{}{"buffered"}); err != nil {
+		t.Fatal(err)
+	}
+	breaker.record(errors.New("failure"))
+	close(release)
+	if err := c.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	// batch published by connected client
+	if err := c.Send(cb, []interface{}{"connected"}); err != ErrCircuitOpen {
+		t.Fatalf("expected %v, got %v", ErrCircuitOpen, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-results:
+			if err != ErrCircuitOpen {
+				t.Errorf("expected callback with %v, got %v", ErrCircuitOpen, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("callback not called")
+		}
+	}
+}
+
+func TestLazyClientCallbackOnConnectError(t *testing.T) {
+	errDial := errors.New("dial failed")
+	dial := func(network, address string) (net.Conn, error) {
+		return nil, errDial
+	}
+
+	c := NewLazyClientWith(dial, "", 1, 4)
+	defer c.Close()
+	if err := c.Wait(); err != errDial {
+		t.Fatalf("expected %v, got %v", errDial, err)
+	}
+
+	called := make(chan error, 1)
+	err := c.Send(func(seq uint32, err error) { called <- err }, []interface{}{"event"})
+	if err != errDial {
+		t.Fatalf("expected %v, got %v", errDial, err)
+	}
+	if err := <-called; err != errDial {
+		t.Errorf("expected callback with %v, got %v", errDial, err)
+	}
+}
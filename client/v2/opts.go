@@ -18,8 +18,10 @@
 package v2
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"time"
 )
 
@@ -30,6 +32,27 @@ type options struct {
 	timeout     time.Duration
 	encoder     jsonEncoder
 	compressLvl int
+
+	compressThreshold int
+
+	sndBuf int
+	rcvBuf int
+
+	streamBuf int
+
+	compressStats       func(uncompressed, compressed int)
+	breaker             *Breaker
+	tcpUserTimeout      time.Duration
+	adaptiveCompression bool
+	skipEncodeErrors    bool
+	encrypter           func([]byte) ([]byte, error)
+	tls                 *tls.Config
+	minTLSVersion       uint16
+	maxEventBytes       int
+	oversize            OversizePolicy
+	truncateField       string
+	backoff             Backoff
+	connectMeta         map[string]interface{}
 }
 
 type jsonEncoder func(interface{}) ([]byte, error)
@@ -65,6 +88,235 @@ func CompressionLevel(l int) Option {
 	}
 }
 
+// CompressionThreshold client option setting the minimum size in bytes of the
+// serialized batch for compression to be applied. Batches smaller than the
+// threshold are sent uncompressed. The option has no effect if compression is
+// disabled. A threshold of 0 compresses all batches (default).
+func CompressionThreshold(bytes int) Option {
+	return func(opt *options) error {
+		if bytes < 0 {
+			return errors.New("compression threshold must not be negative")
+		}
+		opt.compressThreshold = bytes
+		return nil
+	}
+}
+
+// SendBufferBytes client option setting the socket send buffer size of the
+// TCP connection. The operating system might round or cap the requested size
+// (e.g. Linux doubles the value and caps it at net.core.wmem_max). The option
+// has no effect on connections other than *net.TCPConn.
+func SendBufferBytes(n int) Option {
+	return func(opt *options) error {
+		if n <= 0 {
+			return errors.New("send buffer size must be positive")
+		}
+		opt.sndBuf = n
+		return nil
+	}
+}
+
+// RecvBufferBytes client option setting the socket receive buffer size of the
+// TCP connection. The operating system might round or cap the requested size
+// (e.g. Linux doubles the value and caps it at net.core.rmem_max). The option
+// has no effect on connections other than *net.TCPConn.
+func RecvBufferBytes(n int) Option {
+	return func(opt *options) error {
+		if n <= 0 {
+			return errors.New("receive buffer size must be positive")
+		}
+		opt.rcvBuf = n
+		return nil
+	}
+}
+
+// StreamBufferSize client option enabling streaming of batches directly to the
+// network connection. Events are encoded and written via a buffer of the given
+// size, such that peak memory usage does not depend on the batch size. With
+// compression enabled, a batch is split into multiple compressed frames, each
+// holding about size bytes of uncompressed events. CompressionThreshold is
+// ignored in streaming mode. A size of 0 disables streaming (default).
+// If an event fails to be encoded while streaming, the connection is closed,
+// as the partially written window can not be recalled. Use SkipEncodeErrors
+// for encoding all events before the window is written.
+func StreamBufferSize(size int) Option {
+	return func(opt *options) error {
+		if size < 0 {
+			return errors.New("stream buffer size must not be negative")
+		}
+		opt.streamBuf = size
+		return nil
+	}
+}
+
+// CompressionStats client option registering a callback being called with the
+// uncompressed and compressed payload sizes in bytes after a batch has been
+// compressed. Batches sent uncompressed are not reported. The callback must
+// not block.
+func CompressionStats(fn func(uncompressed, compressed int)) Option {
+	return func(opt *options) error {
+		opt.compressStats = fn
+		return nil
+	}
+}
+
+// CircuitBreaker client option installing a circuit breaker with SyncClient
+// and AsyncClient. Publish requests fail with ErrCircuitOpen while the breaker
+// is open. By default no circuit breaker is used.
+func CircuitBreaker(b *Breaker) Option {
+	return func(opt *options) error {
+		opt.breaker = b
+		return nil
+	}
+}
+
+// TCPUserTimeout client option setting the maximum time transmitted data may
+// remain unacknowledged by the peer, before the connection is closed
+// (TCP_USER_TIMEOUT). This allows dead peers to be detected quickly. The
+// option is only supported on Linux and is ignored with a logged warning on
+// other platforms. It has no effect on connections other than *net.TCPConn.
+func TCPUserTimeout(d time.Duration) Option {
+	return func(opt *options) error {
+		if d < 0 {
+			return errors.New("tcp user timeout must not be negative")
+		}
+		opt.tcpUserTimeout = d
+		return nil
+	}
+}
+
+// AdaptiveCompression client option sending a batch uncompressed if the
+// compressed frame would not be smaller than the uncompressed payload. The
+// batch is serialized into an intermediate buffer first, adding a copy of the
+// payload on top of the compression cost. The option has no effect if
+// compression is disabled and is ignored in streaming mode.
+func AdaptiveCompression(b bool) Option {
+	return func(opt *options) error {
+		opt.adaptiveCompression = b
+		return nil
+	}
+}
+
+// SkipEncodeErrors client option dropping events failing to be JSON-encoded
+// from a batch, instead of failing the complete batch. Encoding failures are
+// logged and the remaining events are sent. Use Skipped to query the number of
+// events dropped from the last batch.
+func SkipEncodeErrors(b bool) Option {
+	return func(opt *options) error {
+		opt.skipEncodeErrors = b
+		return nil
+	}
+}
+
+// PayloadEncrypter client option encrypting the payload of compressed data
+// frames with fn, for end-to-end confidentiality of events if TLS is
+// terminated by an untrusted proxy. Encrypted frames are sent with the frame
+// code 'E' and must be decrypted by the server via the matching
+// PayloadDecrypter option. fn must not retain the passed buffer.
+// Encryption requires compression to be enabled. All data frames are
+// compressed, ignoring CompressionThreshold and AdaptiveCompression.
+// Metadata frames are not encrypted.
+func PayloadEncrypter(fn func(plain []byte) ([]byte, error)) Option {
+	return func(opt *options) error {
+		opt.encrypter = fn
+		return nil
+	}
+}
+
+// TLS client option enabling TLS for connections established by Dial and
+// DialWith. If ServerName is not set, the host of the dialed address is used
+// for verifying the server certificate. Connections passed to NewWithConn are
+// used as is.
+func TLS(config *tls.Config) Option {
+	return func(opt *options) error {
+		opt.tls = config
+		return nil
+	}
+}
+
+// MinTLSVersion client option setting the minimum TLS version, e.g.
+// tls.VersionTLS12. Enables TLS with default settings if no configuration has
+// been given via the TLS option. The configuration passed to TLS is not
+// modified.
+func MinTLSVersion(v uint16) Option {
+	return func(opt *options) error {
+		switch v {
+		case tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13:
+		default:
+			return fmt.Errorf("unknown TLS version 0x%04x", v)
+		}
+		opt.minTLSVersion = v
+		return nil
+	}
+}
+
+// OversizePolicy selects how events exceeding MaxEventBytes are handled.
+type OversizePolicy int
+
+const (
+	// OversizeError fails the complete batch with ErrEventTooLarge.
+	OversizeError OversizePolicy = iota
+
+	// OversizeDrop drops oversized events from the batch. Dropped events are
+	// reported by Skipped.
+	OversizeDrop
+
+	// OversizeTruncate shortens the string field configured via
+	// TruncateField until the event fits. Events not fitting even with the
+	// field being empty, or missing the field, are dropped.
+	OversizeTruncate
+)
+
+// MaxEventBytes client option limiting the size of a single JSON-encoded
+// event to n bytes. Oversized events are handled according to policy, such
+// that a single oversized event does not get the complete batch rejected
+// downstream. A value of 0 disables the limit.
+func MaxEventBytes(n int, policy OversizePolicy) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("max event bytes must not be negative")
+		}
+		opt.maxEventBytes = n
+		opt.oversize = policy
+		return nil
+	}
+}
+
+// TruncateField client option configuring the top-level string field being
+// truncated by the OversizeTruncate policy, e.g. "message".
+func TruncateField(name string) Option {
+	return func(opt *options) error {
+		opt.truncateField = name
+		return nil
+	}
+}
+
+// RetryBackoff client option configuring the Backoff used by retrying client
+// features. If set, LazyClient retries failed connection attempts until
+// closed. By default no retries are attempted.
+func RetryBackoff(b Backoff) Option {
+	return func(opt *options) error {
+		opt.backoff = b
+		return nil
+	}
+}
+
+// ConnectMeta client option sending meta as connection level metadata once
+// after connecting. Servers supporting connection metadata add the fields to
+// the metadata of every batch received on the connection, such that labels
+// constant for the connection do not need to be sent with every batch.
+// Note: Connection metadata is an extension to the lumberjack protocol.
+// Servers not supporting connection metadata close the connection.
+func ConnectMeta(meta map[string]string) Option {
+	return func(opt *options) error {
+		opt.connectMeta = make(map[string]interface{}, len(meta))
+		for k, v := range meta {
+			opt.connectMeta[k] = v
+		}
+		return nil
+	}
+}
+
 func applyOptions(opts []Option) (options, error) {
 	o := options{
 		encoder: json.Marshal,
@@ -76,5 +328,22 @@ func applyOptions(opts []Option) (options, error) {
 			return o, err
 		}
 	}
+
+	if o.minTLSVersion != 0 {
+		if o.tls == nil {
+			o.tls = &tls.Config{}
+		} else {
+			o.tls = o.tls.Clone()
+		}
+		o.tls.MinVersion = o.minTLSVersion
+	}
+
+	if o.maxEventBytes > 0 && o.oversize == OversizeTruncate && o.truncateField == "" {
+		return o, errors.New("truncating oversized events requires a truncate field")
+	}
+
+	if o.encrypter != nil && o.compressLvl == 0 {
+		return o, errors.New("payload encryption requires compression")
+	}
 	return o, nil
 }
@@ -0,0 +1,45 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v2
+
+import (
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zlib"
+)
+
+// zlibWriters pools zlib writers per compression level. Allocating a new
+// compressor per batch dominates the allocations of small batches.
+var zlibWriters [zlib.BestCompression + 1]sync.Pool
+
+// getZlibWriter returns a zlib writer writing to w, reusing a pooled writer
+// if available.
+func getZlibWriter(w io.Writer, level int) (*zlib.Writer, error) {
+	if zw, ok := zlibWriters[level].Get().(*zlib.Writer); ok {
+		zw.Reset(w)
+		return zw, nil
+	}
+	return zlib.NewWriterLevel(w, level)
+}
+
+// putZlibWriter returns zw to the pool. zw must not be used afterwards.
+func putZlibWriter(zw *zlib.Writer, level int) {
+	zw.Reset(nil)
+	zlibWriters[level].Put(zw)
+}
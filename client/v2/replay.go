@@ -0,0 +1,57 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v2
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/elastic/go-lumber/lj"
+)
+
+// ReplayFrom reads batches recorded by the servers RecordTo option from r and
+// publishes them via cl, preserving batch boundaries and metadata. If timing
+// is set, ReplayFrom waits between batches for the time passed between the
+// batches having been received originally. Returns the number of batches
+// replayed.
+func ReplayFrom(r io.Reader, cl *SyncClient, timing bool) (int, error) {
+	dec := json.NewDecoder(r)
+
+	var last time.Time
+	count := 0
+	for {
+		var rec lj.Record
+		if err := dec.Decode(&rec); err != nil {
+			if err == io.EOF {
+				return count, nil
+			}
+			return count, err
+		}
+
+		if timing && !last.IsZero() {
+			time.Sleep(rec.ReceivedAt.Sub(last))
+		}
+		last = rec.ReceivedAt
+
+		if _, err := cl.SendWithMeta(rec.Meta, rec.Events); err != nil {
+			return count, err
+		}
+		count++
+	}
+}
@@ -70,14 +70,74 @@ func (c *SyncClient) Close() error {
 	return c.cl.Close()
 }
 
-// Send publishes a new batch of events by JSON-encoding given batch.
+// Send publishes a new batch of events by JSON-encoding given batch. Events
+// can be maps or any other value supported by the configured JSON encoder,
+// like structs with `json` tags.
 // Send blocks until the complete batch has been ACKed by lumberjack server or
-// some error happened.
+// some error happened. If the circuit breaker is open, ErrCircuitOpen is
+// returned.
 func (c *SyncClient) Send(data []interface{}) (int, error) {
-	if err := c.cl.Send(data); err != nil {
+	return c.SendWithMeta(nil, data)
+}
+
+// SendWithMeta publishes a new batch of events with batch level metadata.
+// See Client.SendWithMeta for details on metadata.
+func (c *SyncClient) SendWithMeta(meta map[string]interface{}, data []interface{}) (int, error) {
+	n, _, err := c.SendSeq(meta, data)
+	return n, err
+}
+
+// SendSeq publishes a new batch of events like SendWithMeta. In addition to
+// the number of events ACKed, the last sequence number ACKed by the server is
+// returned. The sequence number differs from the number of events ACKed if
+// events have been dropped due to SkipEncodeErrors or MaxEventBytes. Clients
+// implementing their own checkpointing can persist the sequence number for
+// resuming.
+func (c *SyncClient) SendSeq(meta map[string]interface{}, data []interface{}) (int, uint32, error) {
+	breaker := c.cl.opts.breaker
+	if breaker != nil {
+		if err := breaker.allow(); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	n, seq, err := c.send(meta, data)
+	if breaker != nil {
+		breaker.record(err)
+	}
+	return n, seq, err
+}
+
+func (c *SyncClient) send(meta map[string]interface{}, data []interface{}) (int, uint32, error) {
+	if err := c.cl.SendWithMeta(meta, data); err != nil {
+		return 0, 0, err
+	}
+
+	window, mapSeq := c.cl.lastWindow()
+	seq, err := c.cl.AwaitACK(window)
+	return int(mapSeq(seq)), seq, err
+}
+
+// Skipped returns the number of events dropped from the last batch due to
+// encoding errors or exceeding the event size limit. See SkipEncodeErrors and
+// MaxEventBytes.
+func (c *SyncClient) Skipped() int {
+	return c.cl.Skipped()
+}
+
+// SendOnce connects to the lumberjack server, publishes a single batch of
+// events, waits for the batch being ACKed and closes the connection. Returns
+// the number of ACKed events. The connection is always closed, even if an
+// error occurred.
+func SendOnce(address string, data []interface{}, opts ...Option) (int, error) {
+	cl, err := SyncDial(address, opts...)
+	if err != nil {
 		return 0, err
 	}
 
-	seq, err := c.cl.AwaitACK(uint32(len(data)))
-	return int(seq), err
+	n, err := cl.Send(data)
+	if cerr := cl.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
 }
@@ -25,6 +25,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -47,11 +48,24 @@ func main() {
 	v2 := flag.Bool("v2", false, "Enable protocol version v2")
 	limit := flag.Int("rate", 0, "max batch ack rate")
 	detailed := flag.Bool("d", false, "detailed: print log message per event")
+	record := flag.String("record", "", "record received batches to file")
+	drain := flag.Duration("drain", 5*time.Second, "max time to wait for pending batches on shutdown")
 	flag.Parse()
 
-	s, err := server.ListenAndServe(*bind,
+	opts := []server.Option{
 		server.V1(*v1),
-		server.V2(*v2))
+		server.V2(*v2),
+	}
+	if *record != "" {
+		f, err := os.Create(*record)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		opts = append(opts, server.RecordTo(f))
+	}
+
+	s, err := server.ListenAndServe(*bind, opts...)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -67,10 +81,15 @@ func main() {
 	signal.Notify(sig, os.Interrupt, os.Kill)
 	go func() {
 		<-sig
+		log.Println("shutting down, waiting for pending batches")
+		ctx, cancel := context.WithTimeout(context.Background(), *drain)
+		if err := s.(server.Shutdowner).Shutdown(ctx); err != nil {
+			log.Printf("shutdown: %v", err)
+		}
+		cancel()
 		if rl != nil {
 			rl.Stop()
 		}
-		_ = s.Close()
 		os.Exit(0)
 	}()
 
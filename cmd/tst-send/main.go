@@ -42,8 +42,20 @@ func main() {
 	batchSize := flag.Int("batch", 2048, "Batch size")
 	pipelined := flag.Int("pipeline", 0, "enabled pipeline mode with number of batches kept in pipeline")
 	httpprof := flag.String("httpprof", ":6060", "HTTP profiling server address")
+	replay := flag.String("replay", "", "replay batches recorded by tst-lj from file and exit")
+	timing := flag.Bool("timing", false, "preserve original timing between replayed batches")
 	flag.Parse()
 
+	if *replay != "" {
+		if err := replayFile(*replay, *connect, *timing,
+			v2.CompressionLevel(*compress),
+			v2.Timeout(*timeout)); err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	stat := expvar.NewInt("ACKed")
 
 	batch := make([]interface{}, *batchSize)
@@ -105,6 +117,24 @@ func main() {
 	}
 }
 
+func replayFile(path, address string, timing bool, opts ...v2.Option) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cl, err := v2.SyncDial(address, opts...)
+	if err != nil {
+		return err
+	}
+	defer cl.Close()
+
+	n, err := v2.ReplayFrom(f, cl, timing)
+	log.Printf("replayed %v batches", n)
+	return err
+}
+
 var (
 	text = strings.Split(`Lorem ipsum dolor sit amet, consetetur sadipscing elitr,
 sed diam nonumy eirmod tempor invidunt ut labore et dolore magna aliquyam erat,
@@ -0,0 +1,105 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package lj
+
+import "sync"
+
+// cloneGroup joins the ACKs of a batch and its clones. The original batch
+// reports the minimum number of events ACKed by all group members to the
+// server.
+type cloneGroup struct {
+	mu      sync.Mutex
+	root    *Batch
+	members []*Batch
+}
+
+// Clone creates an independent copy of the batch sharing the same events,
+// for delivering a batch to multiple consumers. Each consumer must ACK its
+// own copy. The ACK is propagated to the client only once the original batch
+// and all its clones have been ACKed. Await and ACKed on a clone report the
+// clone's own ACK state. Clones of clones join the same group.
+// Clone must be called before the batch is ACKed.
+func (b *Batch) Clone() *Batch {
+	root := b
+	if g := b.cloneGroup(); g != nil {
+		root = g.root
+	}
+
+	root.cloneMu.Lock()
+	g := root.group
+	if g == nil {
+		g = &cloneGroup{root: root, members: []*Batch{root}}
+		root.own = root.ACKed()
+		root.group = g
+	}
+	root.cloneMu.Unlock()
+
+	c := &Batch{
+		Events:              b.Events,
+		ID:                  b.ID,
+		ReceivedAt:          b.ReceivedAt,
+		Meta:                b.Meta,
+		ctx:                 b.ctx,
+		PeerCertFingerprint: b.PeerCertFingerprint,
+		Listener:            b.Listener,
+		ack:                 make(chan struct{}),
+		progress:            make(chan struct{}, 1),
+		size:                b.size,
+		window:              b.window,
+		kept:                b.kept,
+		group:               g,
+	}
+
+	g.mu.Lock()
+	g.members = append(g.members, c)
+	g.mu.Unlock()
+	return c
+}
+
+func (b *Batch) cloneGroup() *cloneGroup {
+	b.cloneMu.Lock()
+	defer b.cloneMu.Unlock()
+	return b.group
+}
+
+// update records n events being ACKed by member b and forwards the minimum
+// number of events ACKed by all members to the original batch.
+func (g *cloneGroup) update(b *Batch, n int) {
+	if n > len(b.Events) {
+		n = len(b.Events)
+	}
+
+	g.mu.Lock()
+	if n <= b.own && n < len(b.Events) {
+		g.mu.Unlock()
+		return
+	}
+	b.own = n
+	min := n
+	for _, m := range g.members {
+		if m.own < min {
+			min = m.own
+		}
+	}
+	g.mu.Unlock()
+
+	if b != g.root {
+		b.ackUpToLocal(n)
+	}
+	g.root.ackUpToLocal(min)
+}
@@ -18,25 +18,200 @@
 // Package lj implements common lumberjack types and functions.
 package lj
 
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
 // Batch is an ACK-able batch of events as has been received by lumberjack
 // server implemenentations. Batches must be ACKed, for the server
 // implementations returning an ACK to it's clients.
 type Batch struct {
 	Events []interface{}
-	ack    chan struct{}
+
+	// ID uniquely identifies the batch within the process. IDs are assigned
+	// in increasing order on batch creation.
+	ID uint64
+
+	// ReceivedAt is the time the batch has been created by the server.
+	ReceivedAt time.Time
+
+	// Meta holds the batch level metadata sent by the client, if any.
+	// Connection level metadata sent by the client is included, with batch
+	// level fields taking precedence.
+	Meta map[string]interface{}
+
+	// PeerCertFingerprint is the hex encoded SHA-256 fingerprint of the TLS
+	// client certificate, if the client authenticated with a certificate.
+	PeerCertFingerprint string
+
+	// Listener identifies the listener which accepted the connection the
+	// batch has been received on. Holds the listener's label, if configured,
+	// or its network address.
+	Listener string
+
+	ack      chan struct{}
+	ackOnce  sync.Once
+	acked    uint32 // number of events ACKed, accessed atomically
+	progress chan struct{}
+	size     int
+
+	window int   // number of events sent by the client, if events have been dropped
+	kept   []int // window index of each event, if events have been dropped
+
+	ctx context.Context
+
+	cloneMu sync.Mutex
+	group   *cloneGroup // set once the batch has been cloned
+	own     int         // events ACKed by this batch's consumer, guarded by group
 }
 
+var batchID uint64
+
 // NewBatch creates a new ACK-able batch.
 func NewBatch(evts []interface{}) *Batch {
-	return &Batch{evts, make(chan struct{})}
+	return &Batch{
+		Events:     evts,
+		ID:         atomic.AddUint64(&batchID, 1),
+		ReceivedAt: time.Now(),
+		ack:        make(chan struct{}),
+		progress:   make(chan struct{}, 1),
+	}
+}
+
+// NewBatchWithSize creates a new ACK-able batch, recording the number of
+// payload bytes the events have been decoded from.
+func NewBatchWithSize(evts []interface{}, size int) *Batch {
+	b := NewBatch(evts)
+	b.size = size
+	return b
 }
 
 // ACK acknowledges a batch initiating propagation of ACK to clients.
+// Calling ACK multiple times is safe. If the batch has been cloned, the ACK is
+// propagated to clients only once the batch and all its clones have been
+// ACKed.
 func (b *Batch) ACK() {
-	close(b.ack)
+	if g := b.cloneGroup(); g != nil {
+		g.update(b, len(b.Events))
+		return
+	}
+	b.ackLocal()
+}
+
+func (b *Batch) ackLocal() {
+	b.ackOnce.Do(func() {
+		atomic.StoreUint32(&b.acked, uint32(len(b.Events)))
+		close(b.ack)
+	})
+}
+
+// ACKUpTo acknowledges the first n events of the batch, so servers can return
+// partial ACKs to clients while the batch is still being processed. ACKUpTo
+// can be called repeatedly with increasing n. Calls not exceeding the number
+// of events already ACKed are ignored. ACKing all events is equivalent to
+// calling ACK. If the batch has been cloned, the minimum number of events
+// ACKed by the batch and all its clones is propagated to clients.
+func (b *Batch) ACKUpTo(n int) {
+	if g := b.cloneGroup(); g != nil {
+		g.update(b, n)
+		return
+	}
+	b.ackUpToLocal(n)
+}
+
+func (b *Batch) ackUpToLocal(n int) {
+	if n >= len(b.Events) {
+		b.ackLocal()
+		return
+	}
+
+	for {
+		old := atomic.LoadUint32(&b.acked)
+		if n <= int(old) {
+			return
+		}
+		if atomic.CompareAndSwapUint32(&b.acked, old, uint32(n)) {
+			break
+		}
+	}
+
+	// notify server, coalescing notifications not yet consumed
+	select {
+	case b.progress <- struct{}{}:
+	default:
+	}
+}
+
+// ACKed returns the number of events being ACKed.
+func (b *Batch) ACKed() int {
+	return int(atomic.LoadUint32(&b.acked))
+}
+
+// Progress returns a channel signaling partial ACKs done via ACKUpTo.
+func (b *Batch) Progress() <-chan struct{} {
+	return b.progress
+}
+
+// Size returns the number of payload bytes the batch has been decoded from.
+// Size is 0 if the batch has been created without size information.
+func (b *Batch) Size() int {
+	return b.size
+}
+
+// SetWindow records the events sent by the client, if the server dropped
+// events before handing the batch to consumers. Window is the number of events
+// sent by the client, and kept holds the window index of each event remaining
+// in Events. SetWindow is to be used by server implementations.
+func (b *Batch) SetWindow(window int, kept []int) {
+	b.window = window
+	b.kept = kept
+}
+
+// WindowACKed returns the number of events to be ACKed to the client, if n
+// events of the batch have been ACKed. Events dropped by the server are
+// ACKed together with the events preceding them.
+func (b *Batch) WindowACKed(n int) int {
+	if b.kept == nil {
+		return n
+	}
+	if n >= len(b.kept) {
+		return b.window
+	}
+	return b.kept[n]
+}
+
+// Context returns the context of the batch. Servers cancel the context once
+// the connection the batch has been received from is closed, such that
+// consumers can abort processing batches which can not be ACKed to the
+// client anymore. Returns context.Background() if no context has been set.
+func (b *Batch) Context() context.Context {
+	if b.ctx == nil {
+		return context.Background()
+	}
+	return b.ctx
+}
+
+// SetContext sets the context returned by Context. SetContext is to be used
+// by server implementations before the batch is handed to consumers.
+func (b *Batch) SetContext(ctx context.Context) {
+	b.ctx = ctx
 }
 
 // Await returns a channel for waiting for a batch to be ACKed.
 func (b *Batch) Await() <-chan struct{} {
 	return b.ack
 }
+
+// AwaitContext blocks until the batch has been ACKed or ctx is cancelled.
+// Returns ctx.Err() if ctx is cancelled before the batch has been ACKed.
+func (b *Batch) AwaitContext(ctx context.Context) error {
+	select {
+	case <-b.ack:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
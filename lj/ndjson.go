@@ -0,0 +1,113 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package lj
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// MarshalNDJSON encodes all events as newline delimited JSON, one event per
+// line.
+func (b *Batch) MarshalNDJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := newLineEncoder(&buf)
+	for _, event := range b.Events {
+		if err := enc.Encode(event); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// MarshalBulk encodes all events as Elasticsearch bulk request body. Every
+// event is preceded by an action line. The action is configured by the
+// event's @metadata fields, if present:
+//   - op_type: bulk action, "index" by default. Delete actions have no source
+//     line, update actions send the event as partial document
+//   - index: target index, defaultIndex if missing
+//   - _id: document ID
+//   - pipeline: ingest pipeline
+//
+// The @metadata field itself is not included in the document.
+func (b *Batch) MarshalBulk(defaultIndex string) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := newLineEncoder(&buf)
+	for _, event := range b.Events {
+		op, action, doc := bulkAction(event, defaultIndex)
+		if err := enc.Encode(map[string]interface{}{op: action}); err != nil {
+			return nil, err
+		}
+		if op == "delete" {
+			continue
+		}
+		if op == "update" {
+			doc = map[string]interface{}{"doc": doc}
+		}
+		if err := enc.Encode(doc); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func newLineEncoder(buf *bytes.Buffer) *json.Encoder {
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	return enc
+}
+
+// bulkAction returns the bulk operation, its parameters and the document to
+// be indexed for an event.
+func bulkAction(event interface{}, defaultIndex string) (string, map[string]interface{}, interface{}) {
+	op := "index"
+	action := map[string]interface{}{}
+	if defaultIndex != "" {
+		action["_index"] = defaultIndex
+	}
+
+	m, ok := event.(map[string]interface{})
+	if !ok {
+		return op, action, event
+	}
+	meta, ok := m["@metadata"].(map[string]interface{})
+	if !ok {
+		return op, action, event
+	}
+
+	if s, ok := meta["op_type"].(string); ok && s != "" {
+		op = s
+	}
+	if s, ok := meta["index"].(string); ok && s != "" {
+		action["_index"] = s
+	}
+	if id, ok := meta["_id"]; ok {
+		action["_id"] = id
+	}
+	if s, ok := meta["pipeline"].(string); ok && s != "" {
+		action["pipeline"] = s
+	}
+
+	doc := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		if k != "@metadata" {
+			doc[k] = v
+		}
+	}
+	return op, action, doc
+}
@@ -0,0 +1,76 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package lj
+
+import "testing"
+
+func TestMarshalBulk(t *testing.T) {
+	event := func(op string) map[string]interface{} {
+		return map[string]interface{}{
+			"message": "hello",
+			"@metadata": map[string]interface{}{
+				"op_type": op,
+				"index":   "logs",
+				"_id":     "1",
+			},
+		}
+	}
+
+	tests := map[string]struct {
+		event    interface{}
+		expected string
+	}{
+		"default": {
+			event: map[string]interface{}{"message": "hello"},
+			expected: `{"index":{"_index":"default"}}` + "\n" +
+				`{"message":"hello"}` + "\n",
+		},
+		"index": {
+			event: event("index"),
+			expected: `{"index":{"_id":"1","_index":"logs"}}` + "\n" +
+				`{"message":"hello"}` + "\n",
+		},
+		"create": {
+			event: event("create"),
+			expected: `{"create":{"_id":"1","_index":"logs"}}` + "\n" +
+				`{"message":"hello"}` + "\n",
+		},
+		"update": {
+			event: event("update"),
+			expected: `{"update":{"_id":"1","_index":"logs"}}` + "\n" +
+				`{"doc":{"message":"hello"}}` + "\n",
+		},
+		"delete": {
+			event:    event("delete"),
+			expected: `{"delete":{"_id":"1","_index":"logs"}}` + "\n",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			b := NewBatch([]interface{}{test.event})
+			raw, err := b.MarshalBulk("default")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(raw) != test.expected {
+				t.Errorf("expected:\n%s\ngot:\n%s", test.expected, raw)
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package lj
+
+import "time"
+
+// Record is the serialized form of a received batch, used for recording and
+// replaying batch streams. Records are stored as newline delimited JSON.
+type Record struct {
+	ReceivedAt time.Time              `json:"received_at"`
+	Meta       map[string]interface{} `json:"meta,omitempty"`
+	Events     []interface{}          `json:"events"`
+}
+
+// NewRecord creates the Record of a batch.
+func NewRecord(b *Batch) Record {
+	return Record{
+		ReceivedAt: b.ReceivedAt,
+		Meta:       b.Meta,
+		Events:     b.Events,
+	}
+}
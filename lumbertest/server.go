@@ -0,0 +1,143 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package lumbertest
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/elastic/go-lumber/lj"
+	"github.com/elastic/go-lumber/server"
+)
+
+// Server is an in-memory lumberjack server recording all received events.
+// By default batches are forwarded to the test via Receive and must be ACKed
+// by the test, giving full control over ACK timing. Use SetAutoACK to ACK
+// batches immediately instead.
+type Server struct {
+	l       *pipeListener
+	server  server.Server
+	autoACK int32
+
+	mu     sync.Mutex
+	events []interface{}
+
+	ch   chan *lj.Batch
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewServer creates a new in-memory server. Only protocol version 2 is
+// enabled by default. Pass server.V1(true) for serving both protocol versions.
+// The options are passed to the lumberjack server, e.g. use
+// server.FaultInjector to inject errors. The server.Channel option must not be
+// used.
+func NewServer(opts ...server.Option) (*Server, error) {
+	l := newPipeListener()
+	opts = append([]server.Option{server.V1(false), server.V2(true)}, opts...)
+	srv, err := server.NewWithListener(l, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		l:      l,
+		server: srv,
+		ch:     make(chan *lj.Batch),
+		done:   make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+func (s *Server) run() {
+	defer s.wg.Done()
+	defer close(s.ch)
+
+	for b := range s.server.ReceiveChan() {
+		s.mu.Lock()
+		s.events = append(s.events, b.Events...)
+		s.mu.Unlock()
+
+		if atomic.LoadInt32(&s.autoACK) == 1 {
+			b.ACK()
+			continue
+		}
+
+		select {
+		case s.ch <- b:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Dial creates a new in-memory connection to the server. The network and
+// address arguments are ignored, such that Dial can be passed as dialer to
+// the clients DialWith functions.
+func (s *Server) Dial(network, address string) (net.Conn, error) {
+	return s.l.dial()
+}
+
+// SetAutoACK configures the server to ACK received batches immediately.
+// Batches being ACKed automatically are not returned by Receive.
+func (s *Server) SetAutoACK(b bool) {
+	var v int32
+	if b {
+		v = 1
+	}
+	atomic.StoreInt32(&s.autoACK, v)
+}
+
+// ReceiveChan returns the channel received batches are forwarded to, if
+// auto ACK is disabled. Batches read from the channel must be ACKed.
+func (s *Server) ReceiveChan() <-chan *lj.Batch {
+	return s.ch
+}
+
+// Receive returns the next received batch. Returns nil if the server has been
+// closed. Batches returned by Receive must be ACKed.
+func (s *Server) Receive() *lj.Batch {
+	return <-s.ch
+}
+
+// Events returns a copy of all events received so far.
+func (s *Server) Events() []interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events := make([]interface{}, len(s.events))
+	copy(events, s.events)
+	return events
+}
+
+// Close closes all active connections and stops the server. Calling Close
+// multiple times is safe.
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.closeErr = s.server.Close()
+		s.wg.Wait()
+	})
+	return s.closeErr
+}
@@ -29,4 +29,15 @@ const (
 	CodeJSONDataFrame byte = 'J'
 	CodeCompressed    byte = 'C'
 	CodeACK           byte = 'A'
+
+	// CodeMetadata declares a batch level metadata frame. Metadata frames
+	// sent outside of a window hold connection level metadata, applying to all
+	// following batches. Metadata frames are an extension to the lumberjack
+	// protocol, not supported by all servers.
+	CodeMetadata byte = 'M'
+
+	// CodeEncrypted declares a compressed data frame with encrypted payload.
+	// Encrypted frames are an extension to the lumberjack protocol, only
+	// supported by servers configured with a payload decrypter.
+	CodeEncrypted byte = 'E'
 )
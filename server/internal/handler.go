@@ -18,6 +18,7 @@
 package internal
 
 import (
+	"context"
 	"net"
 	"sync"
 	"time"
@@ -36,6 +37,10 @@ type defaultHandler struct {
 	signal chan struct{}
 	ch     chan *lj.Batch
 
+	// ctx is set on all batches received and cancelled on Stop
+	ctx    context.Context
+	cancel context.CancelFunc
+
 	stopGuard sync.Once
 }
 
@@ -43,9 +48,10 @@ type BatchReader interface {
 	ReadBatch() (*lj.Batch, error)
 }
 
+// ACKWriter sends ACKs for the window of count events the client has sent.
 type ACKWriter interface {
-	Keepalive(int) error
-	ACK(int) error
+	Keepalive(seq, count int) error
+	ACK(seq, count int) error
 }
 
 type ProtocolFactory func(conn net.Conn) (BatchReader, ACKWriter, error)
@@ -60,7 +66,10 @@ func DefaultHandler(
 			return nil, err
 		}
 
+		ctx, cancel := context.WithCancel(context.Background())
 		return &defaultHandler{
+			ctx:       ctx,
+			cancel:    cancel,
 			cb:        cb,
 			client:    client,
 			reader:    r,
@@ -73,20 +82,34 @@ func DefaultHandler(
 }
 
 func (h *defaultHandler) Run() {
-	defer close(h.ch)
+	acked := make(chan struct{})
 
 	// start async routine for returning ACKs to client.
 	// Sends ACK of 0 every 'keepalive' seconds to signal
 	// client the batch still being in pipeline
-	go h.ackLoop()
-	if err := h.handle(); err != nil {
+	go func() {
+		defer close(acked)
+		h.ackLoop()
+	}()
+
+	err := h.handle()
+	close(h.ch)
+	switch err {
+	case nil:
+	case errBatchLimit:
+		// wait for pending batches being ACKed before closing the connection
+		log.Printf("Batch limit reached, closing connection to %v", h.client.RemoteAddr())
+		<-acked
+	default:
 		log.Println(err)
 	}
+	h.Stop()
 }
 
 func (h *defaultHandler) Stop() {
 	h.stopGuard.Do(func() {
 		close(h.signal)
+		h.cancel()
 		_ = h.client.Close()
 	})
 }
@@ -94,7 +117,6 @@ func (h *defaultHandler) Stop() {
 func (h *defaultHandler) handle() error {
 	log.Printf("Start client handler")
 	defer log.Printf("client handler stopped")
-	defer h.Stop()
 
 	for {
 		// 1. read data into batch
@@ -103,20 +125,43 @@ func (h *defaultHandler) handle() error {
 			return err
 		}
 
-		// read next batch if empty batch has been received
+		// Empty window received. Some clients use empty windows as heartbeat,
+		// expecting an ACK of 0. Push nil to the ACK queue, for sending the
+		// ACK after the ACKs of pending batches. No batch is forwarded.
 		if b == nil {
+			select {
+			case <-h.signal:
+				return nil
+			case h.ch <- nil:
+			}
 			continue
 		}
 
-		// 2. push batch to ACK queue
+		b.SetContext(h.ctx)
+
+		// 2. wait for batch to be admitted and push batch to ACK queue
+		if !h.cb.Admit(b) {
+			return nil
+		}
 		select {
 		case <-h.signal:
+			h.cb.Done(b)
 			return nil
 		case h.ch <- b:
 		}
 
+		// All events have been dropped by the reader. ACK the batch right away,
+		// without forwarding it.
+		if len(b.Events) == 0 {
+			b.ACK()
+			continue
+		}
+
 		// 3. push batch to server receive queue:
 		if err := h.cb.OnEvents(b); err != nil {
+			if err == errBatchLimit {
+				return err
+			}
 			return nil
 		}
 	}
@@ -130,7 +175,10 @@ func (h *defaultHandler) ackLoop() {
 	// Stop ACKing batches in case of error, forcing client to reconnect
 	defer func() {
 		log.Println("drain ack loop")
-		for range h.ch {
+		for b := range h.ch {
+			if b != nil {
+				h.cb.Done(b)
+			}
 		}
 	}()
 
@@ -143,7 +191,20 @@ func (h *defaultHandler) ackLoop() {
 			if !open {
 				return
 			}
-			if err := h.waitACK(b); err != nil {
+			if b == nil {
+				if err := h.writer.ACK(0, 0); err != nil {
+					log.Printf("Failed to send ACK: %v", err)
+					h.Stop()
+					return
+				}
+				continue
+			}
+
+			err := h.waitACK(b)
+			h.cb.Done(b)
+			if err != nil {
+				log.Printf("Failed to send ACK: %v", err)
+				h.Stop()
 				return
 			}
 		}
@@ -152,31 +213,35 @@ func (h *defaultHandler) ackLoop() {
 
 func (h *defaultHandler) waitACK(batch *lj.Batch) error {
 	n := len(batch.Events)
+	window := batch.WindowACKed(n)
+	sent := 0
 
-	if h.keepalive <= 0 {
-		for {
-			select {
-			case <-h.signal:
-				return nil
-			case <-batch.Await():
-				// send ack
-				return h.writer.ACK(n)
-			}
+	for {
+		// Sends ACK of 0 every 'keepalive' seconds, if keepalive is enabled.
+		var keepalive <-chan time.Time
+		if h.keepalive > 0 {
+			keepalive = time.After(h.keepalive)
 		}
-	} else {
-		for {
-			select {
-			case <-h.signal:
-				return nil
-			case <-batch.Await():
-				// send ack
-				return h.writer.ACK(n)
-			case <-time.After(h.keepalive):
-				if err := h.writer.Keepalive(0); err != nil {
+
+		select {
+		case <-h.signal:
+			return nil
+		case <-batch.Await():
+			// send ack
+			h.cb.OnACK(batch)
+			return h.writer.ACK(window, window)
+		case <-batch.Progress():
+			// send partial ack
+			if acked := batch.ACKed(); acked > sent && acked < n {
+				sent = acked
+				if err := h.writer.ACK(batch.WindowACKed(acked), window); err != nil {
 					return err
 				}
 			}
+		case <-keepalive:
+			if err := h.writer.Keepalive(0, window); err != nil {
+				return err
+			}
 		}
 	}
-
 }
@@ -0,0 +1,93 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/elastic/go-lumber/lj"
+)
+
+// inflightBatches tracks batches being enqueued, but not yet ACKed.
+type inflightBatches struct {
+	mu      sync.Mutex
+	batches map[uint64]*lj.Batch
+}
+
+func newInflightBatches() *inflightBatches {
+	return &inflightBatches{batches: map[uint64]*lj.Batch{}}
+}
+
+func (f *inflightBatches) add(b *lj.Batch) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.batches[b.ID] = b
+}
+
+func (f *inflightBatches) remove(b *lj.Batch) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.batches, b.ID)
+}
+
+func (f *inflightBatches) len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.batches)
+}
+
+func (f *inflightBatches) contains(b *lj.Batch) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, exists := f.batches[b.ID]
+	return exists
+}
+
+// watch removes b once it gets ACKed and calls onACK. Used for batches no
+// connection handler is waiting for anymore. If done is closed first, b stays
+// registered.
+func (f *inflightBatches) watch(b *lj.Batch, done <-chan struct{}, onACK func()) {
+	go func() {
+		select {
+		case <-b.Await():
+			f.remove(b)
+			onACK()
+		case <-done:
+		}
+	}()
+}
+
+// list returns all batches not yet ACKed, ordered by batch ID.
+func (f *inflightBatches) list() []*lj.Batch {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	batches := make([]*lj.Batch, 0, len(f.batches))
+	for _, b := range f.batches {
+		select {
+		case <-b.Await():
+			delete(f.batches, b.ID)
+			continue
+		default:
+		}
+		batches = append(batches, b)
+	}
+	sort.Slice(batches, func(i, j int) bool { return batches[i].ID < batches[j].ID })
+	return batches
+}
@@ -0,0 +1,139 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/elastic/go-lumber/log"
+)
+
+// byteLimiter bounds the total number of bytes held by in-flight batches.
+// A batch exceeding the limit on its own is admitted if no other batch is
+// in-flight, so oversized batches can not deadlock a connection.
+type byteLimiter struct {
+	mu   sync.Mutex
+	max  int
+	used int
+
+	// released is closed and replaced every time bytes are returned.
+	released chan struct{}
+}
+
+func newByteLimiter(max int) *byteLimiter {
+	return &byteLimiter{
+		max:      max,
+		released: make(chan struct{}),
+	}
+}
+
+func (l *byteLimiter) acquire(n int, done <-chan struct{}) bool {
+	for {
+		l.mu.Lock()
+		if l.used == 0 || l.used+n <= l.max {
+			l.used += n
+			l.mu.Unlock()
+			return true
+		}
+		released := l.released
+		l.mu.Unlock()
+
+		select {
+		case <-done:
+			return false
+		case <-released:
+		}
+	}
+}
+
+func (l *byteLimiter) release(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.used -= n
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+// Limits holds the connection and in-flight limits of a server. Servers
+// accepting connections from a listener providing Limits share the listener's
+// limits.
+type Limits struct {
+	goroutines    int64 // accessed atomically, kept first for 64-bit alignment
+	maxGoroutines int
+	connRate      *ipRateLimiter
+	bytes         *byteLimiter
+}
+
+// NewLimits creates the limits configured in opts.
+func NewLimits(opts Config) *Limits {
+	l := &Limits{
+		maxGoroutines: opts.MaxHandlerGoroutines,
+	}
+	if opts.MaxInFlightBytes > 0 {
+		l.bytes = newByteLimiter(opts.MaxInFlightBytes)
+	}
+	if opts.PerIPConnRate > 0 {
+		l.connRate = newIPRateLimiter(opts.PerIPConnRate, opts.PerIPConnBurst)
+	}
+	return l
+}
+
+// sharedLimits returns the limits provided by l. Connections accepted from a
+// listener providing limits have been admitted against the limits already.
+func sharedLimits(l net.Listener) *Limits {
+	if sl, ok := l.(interface{ Limits() *Limits }); ok {
+		return sl.Limits()
+	}
+	return nil
+}
+
+// Admit checks a new connection against the per IP connection rate limit and
+// reserves the goroutines of the connection. Returns false if the connection
+// must be closed.
+func (l *Limits) Admit(client net.Conn) bool {
+	if l.connRate != nil && !l.connRate.allow(client.RemoteAddr()) {
+		log.Printf("Connection rate limit exceeded, closing connection from %v",
+			client.RemoteAddr())
+		return false
+	}
+	if !l.acquireGoroutines() {
+		log.Printf("Handler goroutine budget exhausted, closing connection from %v",
+			client.RemoteAddr())
+		return false
+	}
+	return true
+}
+
+// acquireGoroutines reserves the goroutines of a new connection. Returns
+// false if MaxHandlerGoroutines would be exceeded.
+func (l *Limits) acquireGoroutines() bool {
+	n := atomic.AddInt64(&l.goroutines, connGoroutines)
+	if max := l.maxGoroutines; max > 0 && n > int64(max) {
+		atomic.AddInt64(&l.goroutines, -connGoroutines)
+		return false
+	}
+	return true
+}
+
+// ReleaseGoroutines returns the goroutines reserved by Admit.
+func (l *Limits) ReleaseGoroutines() {
+	atomic.AddInt64(&l.goroutines, -connGoroutines)
+}
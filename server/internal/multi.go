@@ -0,0 +1,185 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// MultiListener combines multiple listeners into a single net.Listener.
+// Connections accepted by any of the listeners are returned by Accept.
+type MultiListener struct {
+	listeners []net.Listener
+
+	conns  chan net.Conn
+	done   chan struct{}
+	failed chan struct{} // closed once all listeners have failed
+	err    error         // last accept error, set before failed is closed
+
+	closeOnce sync.Once
+}
+
+var errListenerClosed = errors.New("listener closed")
+
+// NewMultiListener creates a new MultiListener accepting connections from
+// all listeners.
+func NewMultiListener(listeners []net.Listener) *MultiListener {
+	l := &MultiListener{
+		listeners: listeners,
+		conns:     make(chan net.Conn),
+		done:      make(chan struct{}),
+		failed:    make(chan struct{}),
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, ln := range listeners {
+		wg.Add(1)
+		go func(ln net.Listener) {
+			defer wg.Done()
+			if err := l.accept(ln); err != nil {
+				mu.Lock()
+				l.err = err
+				mu.Unlock()
+			}
+		}(ln)
+	}
+	go func() {
+		wg.Wait()
+		close(l.failed)
+	}()
+	return l
+}
+
+func (l *MultiListener) accept(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+
+		select {
+		case l.conns <- conn:
+		case <-l.done:
+			_ = conn.Close()
+			return nil
+		}
+	}
+}
+
+// Accept waits for and returns the next connection accepted by any of the
+// listeners. Returns an error after Close or once all listeners have failed.
+func (l *MultiListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errListenerClosed
+	case <-l.failed:
+		if l.err == nil {
+			return nil, errListenerClosed
+		}
+		return nil, l.err
+	}
+}
+
+// Close closes all listeners. Returns the first error encountered.
+func (l *MultiListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		for _, ln := range l.listeners {
+			if cerr := ln.Close(); err == nil {
+				err = cerr
+			}
+		}
+	})
+	return err
+}
+
+// Addr returns the network address of the first listener.
+func (l *MultiListener) Addr() net.Addr {
+	return l.listeners[0].Addr()
+}
+
+// Addrs returns the network addresses of all listeners.
+func (l *MultiListener) Addrs() []net.Addr {
+	addrs := make([]net.Addr, len(l.listeners))
+	for i, ln := range l.listeners {
+		addrs[i] = ln.Addr()
+	}
+	return addrs
+}
+
+// ListenerAddrs returns all network addresses a listener is bound to.
+func ListenerAddrs(l net.Listener) []net.Addr {
+	if ml, ok := l.(interface{ Addrs() []net.Addr }); ok {
+		return ml.Addrs()
+	}
+	return []net.Addr{l.Addr()}
+}
+
+// LabeledListener attaches a label to a listener, for identifying the
+// listener batches have been received from.
+type LabeledListener struct {
+	net.Listener
+	label string
+}
+
+// NewLabeledListener wraps l, labeling all connections accepted by l.
+func NewLabeledListener(l net.Listener, label string) *LabeledListener {
+	return &LabeledListener{Listener: l, label: label}
+}
+
+// Label returns the label of the listener.
+func (l *LabeledListener) Label(net.Conn) string {
+	return l.label
+}
+
+// Label returns the label of the listener conn has been accepted by.
+func (l *MultiListener) Label(conn net.Conn) string {
+	local := conn.LocalAddr()
+	for _, ln := range l.listeners {
+		if addrMatches(ln.Addr(), local) {
+			return ListenerLabel(ln, conn)
+		}
+	}
+	return local.String()
+}
+
+// ListenerLabel returns the label of the listener conn has been accepted by.
+// The listener's network address is used if no label has been configured.
+func ListenerLabel(l net.Listener, conn net.Conn) string {
+	if ll, ok := l.(interface{ Label(net.Conn) string }); ok {
+		return ll.Label(conn)
+	}
+	return l.Addr().String()
+}
+
+// addrMatches checks if local is an address a listener bound to addr accepts
+// connections on. Listeners bound to unspecified IPs match all IPs.
+func addrMatches(addr, local net.Addr) bool {
+	la, ok1 := addr.(*net.TCPAddr)
+	ca, ok2 := local.(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return addr.String() == local.String()
+	}
+	return la.Port == ca.Port && (la.IP.IsUnspecified() || la.IP.Equal(ca.IP))
+}
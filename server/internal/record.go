@@ -0,0 +1,69 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/elastic/go-lumber/lj"
+	"github.com/elastic/go-lumber/log"
+)
+
+// batchRecorder writes received batches as newline delimited JSON records.
+// Recording is stopped on the first write error.
+type batchRecorder struct {
+	mu     sync.Mutex
+	enc    *json.Encoder
+	failed bool
+}
+
+func newBatchRecorder(w io.Writer) *batchRecorder {
+	return &batchRecorder{enc: json.NewEncoder(w)}
+}
+
+func (r *batchRecorder) record(b *lj.Batch) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.failed {
+		return
+	}
+	if err := r.enc.Encode(lj.NewRecord(b)); err != nil {
+		log.Printf("Failed to record batch, recording stopped: %v", err)
+		r.failed = true
+	}
+}
+
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// LockedWriter serializes writes to w, such that w can be shared by multiple
+// servers recording batches.
+func LockedWriter(w io.Writer) io.Writer {
+	return &lockedWriter{w: w}
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
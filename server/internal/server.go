@@ -18,29 +18,109 @@
 package internal
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/elastic/go-lumber/lj"
 	"github.com/elastic/go-lumber/log"
 )
 
 type Server struct {
+	// counters accessed atomically, kept first for 64-bit alignment
+	events  uint64
+	batches uint64
+	pending int64 // batches admitted, but not yet done
+
+	listening int32 // set to 1 while accept loop is active
+
 	listener net.Listener
 	opts     Config
 	ch       chan *lj.Batch
 	ownCH    bool
 	sig      closeSignaler
+	gate     pauseGate
+	inflight *inflightBatches
+	recorder *batchRecorder
+	ackRate  *rateLimiter
+	limits   *Limits
+	admitted bool          // connections are admitted by the listener
+	idle     chan struct{} // signaled once no batch is pending
+
+	listenerOnce sync.Once
+	listenerErr  error
+	closeOnce    sync.Once
+	closeErr     error
 }
 
 type Config struct {
 	TLS     *tls.Config
 	Handler HandlerFactory
 	Channel chan *lj.Batch
+
+	// Timeout bounds the TLS handshake of accepted connections. No timeout is
+	// applied if <= 0.
+	Timeout time.Duration
+
+	// MaxInFlightBytes limits the total payload size of batches being
+	// enqueued but not yet ACKed. No limit is applied if <= 0.
+	MaxInFlightBytes int
+
+	// ACKLatency is called with the time passed between a batch being received
+	// and being ACKed.
+	ACKLatency func(*lj.Batch, time.Duration)
+
+	// SocketBuffers configures the socket buffer sizes of accepted connections.
+	SocketBuffers SocketBuffers
+
+	// SlowBatchThreshold enables logging of batches taking longer than the
+	// threshold to be ACKed. Disabled if <= 0.
+	SlowBatchThreshold time.Duration
+
+	// MaxBatchesPerConnection closes connections after the given number of
+	// batches has been received and ACKed. No limit is applied if <= 0.
+	MaxBatchesPerConnection int
+
+	// TimestampField names the event field EventLag is computed from.
+	TimestampField string
+
+	// EventLag is called with the time passed between an event's timestamp
+	// and the event being received.
+	EventLag func(time.Duration)
+
+	// Recorder receives a record of every batch received, if set.
+	Recorder io.Writer
+
+	// ACKRateLimit limits the number of batch ACKs sent per second. No limit
+	// is applied if <= 0.
+	ACKRateLimit int
+
+	// MaxHandlerGoroutines limits the number of goroutines spawned by
+	// connection handlers. No limit is applied if <= 0.
+	MaxHandlerGoroutines int
+
+	// AcceptFunc decides whether to serve a connection after the TLS
+	// handshake. All connections are served if nil.
+	AcceptFunc func(net.Conn) bool
+
+	// PerIPConnRate limits the rate of new connections accepted per source
+	// IP, allowing bursts of up to PerIPConnBurst connections. No limit is
+	// applied if <= 0.
+	PerIPConnRate  int
+	PerIPConnBurst int
 }
 
+// connGoroutines is the number of goroutines accounted per connection: the
+// handler reading batches, its ACK loop and the shutdown watcher. Servers
+// multiplexing protocol versions account the goroutines detecting the protocol
+// version against the same budget, before handing the connection to a handler.
+const connGoroutines = 3
+
 type Handler interface {
 	Run()
 	Stop()
@@ -48,25 +128,140 @@ type Handler interface {
 
 type HandlerFactory func(Eventer, net.Conn) (Handler, error)
 
+// Eventer forwards batches received by a Handler. Every batch must be admitted
+// before being pushed to OnEvents. OnACK is called once a batch has been ACKed.
+// Admitted batches must be reported via Done once they have been ACKed or
+// dropped.
 type Eventer interface {
+	Admit(*lj.Batch) bool
 	OnEvents(*lj.Batch) error
+	OnACK(*lj.Batch)
+	Done(*lj.Batch)
 }
 
 type chanCallback struct {
-	done <-chan struct{}
-	ch   chan *lj.Batch
+	s       *Server
+	client  net.Conn
+	batches int
+
+	// fingerprint of the client certificate, computed on first batch, after
+	// the TLS handshake
+	fingerprint *string
+
+	// label of the listener the connection has been accepted by
+	listener string
+}
+
+// errBatchLimit is returned by OnEvents once the connection has delivered
+// the configured maximum number of batches.
+var errBatchLimit = errors.New("batch limit per connection reached")
+
+func newChanCallback(s *Server, client net.Conn) *chanCallback {
+	return &chanCallback{
+		s:        s,
+		client:   client,
+		listener: ListenerLabel(s.listener, client),
+	}
 }
 
-func newChanCallback(done <-chan struct{}, ch chan *lj.Batch) *chanCallback {
-	return &chanCallback{done, ch}
+func (c *chanCallback) Admit(b *lj.Batch) bool {
+	if !c.s.gate.wait(c.s.sig.Sig()) {
+		return false
+	}
+	if c.s.limits.bytes != nil && !c.s.limits.bytes.acquire(b.Size(), c.s.sig.Sig()) {
+		return false
+	}
+	atomic.AddInt64(&c.s.pending, 1)
+	return true
+}
+
+func (c *chanCallback) OnACK(b *lj.Batch) {
+	if c.s.ackRate != nil {
+		c.s.ackRate.wait(c.s.sig.Sig())
+	}
+	c.s.inflight.remove(b)
+
+	latency := time.Since(b.ReceivedAt)
+	if fn := c.s.opts.ACKLatency; fn != nil {
+		fn(b, latency)
+	}
+	if th := c.s.opts.SlowBatchThreshold; th > 0 && latency > th {
+		log.Printf("Slow batch from %v: %v events ACKed after %v",
+			c.client.RemoteAddr(), len(b.Events), latency)
+	}
+}
+
+func (c *chanCallback) Done(b *lj.Batch) {
+	release := func() {
+		if c.s.limits.bytes != nil {
+			c.s.limits.bytes.release(b.Size())
+		}
+	}
+	if c.s.inflight.contains(b) {
+		// batch dropped by handler before ACK. The batch still holds its bytes
+		// until it gets ACKed by the consumer.
+		c.s.inflight.watch(b, c.s.sig.Sig(), release)
+	} else {
+		release()
+	}
+	if atomic.AddInt64(&c.s.pending, -1) == 0 {
+		select {
+		case c.s.idle <- struct{}{}:
+		default:
+		}
+	}
 }
 
 func (c *chanCallback) OnEvents(b *lj.Batch) error {
+	if c.fingerprint == nil {
+		fp := PeerCertFingerprint(c.client)
+		c.fingerprint = &fp
+	}
+	b.PeerCertFingerprint = *c.fingerprint
+	b.Listener = c.listener
+
+	c.reportLag(b)
+	if c.s.recorder != nil {
+		c.s.recorder.record(b)
+	}
+
+	c.s.inflight.add(b)
 	select {
-	case <-c.done:
+	case <-c.s.sig.Sig():
+		c.s.inflight.remove(b)
 		return io.EOF
-	case c.ch <- b:
-		return nil
+	case c.s.ch <- b:
+	}
+	atomic.AddUint64(&c.s.events, uint64(len(b.Events)))
+	atomic.AddUint64(&c.s.batches, 1)
+
+	c.batches++
+	if max := c.s.opts.MaxBatchesPerConnection; max > 0 && c.batches >= max {
+		return errBatchLimit
+	}
+	return nil
+}
+
+func (c *chanCallback) reportLag(b *lj.Batch) {
+	fn, field := c.s.opts.EventLag, c.s.opts.TimestampField
+	if fn == nil || field == "" {
+		return
+	}
+
+	for _, evt := range b.Events {
+		m, ok := evt.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		str, ok := m[field].(string)
+		if !ok {
+			continue
+		}
+		ts, err := time.Parse(time.RFC3339Nano, str)
+		if err != nil {
+			continue
+		}
+		fn(b.ReceivedAt.Sub(ts))
 	}
 }
 
@@ -74,6 +269,8 @@ func NewWithListener(l net.Listener, opts Config) (*Server, error) {
 	s := &Server{
 		listener: l,
 		sig:      makeCloseSignaler(),
+		inflight: newInflightBatches(),
+		idle:     make(chan struct{}, 1),
 		ch:       opts.Channel,
 		opts:     opts,
 	}
@@ -82,7 +279,19 @@ func NewWithListener(l net.Listener, opts Config) (*Server, error) {
 		s.ownCH = true
 		s.ch = make(chan *lj.Batch, 128)
 	}
+	if s.limits = sharedLimits(l); s.limits != nil {
+		s.admitted = true
+	} else {
+		s.limits = NewLimits(opts)
+	}
+	if opts.Recorder != nil {
+		s.recorder = newBatchRecorder(opts.Recorder)
+	}
+	if opts.ACKRateLimit > 0 {
+		s.ackRate = newRateLimiter(opts.ACKRateLimit)
+	}
 
+	atomic.StoreInt32(&s.listening, 1)
 	s.sig.Add(1)
 	go s.run()
 
@@ -101,24 +310,108 @@ func ListenAndServeWith(
 	return NewWithListener(l, opts)
 }
 
-func ListenAndServe(addr string, opts Config) (*Server, error) {
-	binder := net.Listen
-	if opts.TLS != nil {
-		binder = func(network, addr string) (net.Listener, error) {
-			return tls.Listen(network, addr, opts.TLS)
-		}
+// ShutdownTimeout bounds the graceful shutdown of servers started via
+// ListenAndServeContext. Batches not ACKed by then are dropped and the server
+// is closed.
+const ShutdownTimeout = 30 * time.Second
+
+func ListenAndServeContext(ctx context.Context, addr string, opts Config) (*Server, error) {
+	s, err := ListenAndServe(addr, opts)
+	if err != nil {
+		return nil, err
 	}
 
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = ShutdownWithTimeout(s, ShutdownTimeout)
+		case <-s.Done():
+		}
+	}()
+	return s, nil
+}
+
+// ShutdownWithTimeout shuts down s gracefully, closing s if pending batches
+// have not been ACKed within timeout.
+func ShutdownWithTimeout(s interface{ Shutdown(context.Context) error }, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return s.Shutdown(ctx)
+}
+
+func ListenAndServe(addr string, opts Config) (*Server, error) {
+	binder := func(network, addr string) (net.Listener, error) {
+		return Listen(network, addr, opts.TLS, opts.SocketBuffers)
+	}
 	return ListenAndServeWith(binder, addr, opts)
 }
 
 func (s *Server) Close() error {
-	err := s.listener.Close()
-	s.sig.Close()
-	if s.ownCH {
-		close(s.ch)
+	s.closeOnce.Do(func() {
+		s.closeErr = s.closeListener()
+		s.sig.Close()
+		if s.ownCH {
+			close(s.ch)
+		}
+	})
+	return s.closeErr
+}
+
+// Done returns a channel, which is closed once the server has been closed.
+func (s *Server) Done() <-chan struct{} {
+	return s.sig.Sig()
+}
+
+// Shutdown stops accepting new connections and new batches, waiting for all
+// batches already admitted to be ACKed before closing the server. If ctx is
+// done first, the server is closed right away and ctx.Err() is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	_ = s.closeListener()
+	s.gate.pause()
+
+	for atomic.LoadInt64(&s.pending) > 0 {
+		select {
+		case <-ctx.Done():
+			_ = s.Close()
+			return ctx.Err()
+		case <-s.sig.Sig():
+			// closed while waiting for batches being ACKed
+			return s.closeErr
+		case <-s.idle:
+		}
 	}
-	return err
+	return s.Close()
+}
+
+func (s *Server) closeListener() error {
+	s.listenerOnce.Do(func() {
+		s.listenerErr = s.listener.Close()
+	})
+	return s.listenerErr
+}
+
+func (s *Server) UnACKed() []*lj.Batch {
+	return s.inflight.list()
+}
+
+func (s *Server) InFlight() int {
+	return s.inflight.len()
+}
+
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+func (s *Server) EventsReceived() uint64 {
+	return atomic.LoadUint64(&s.events)
+}
+
+func (s *Server) BatchesReceived() uint64 {
+	return atomic.LoadUint64(&s.batches)
+}
+
+func (s *Server) Addrs() []net.Addr {
+	return ListenerAddrs(s.listener)
 }
 
 func (s *Server) Receive() *lj.Batch {
@@ -134,8 +427,35 @@ func (s *Server) ReceiveChan() <-chan *lj.Batch {
 	return s.ch
 }
 
+// IsHealthy reports whether the server is accepting new connections and the
+// receive channel has capacity left for new batches.
+func (s *Server) IsHealthy() bool {
+	select {
+	case <-s.sig.Sig():
+		return false
+	default:
+	}
+
+	if atomic.LoadInt32(&s.listening) == 0 || s.gate.paused() {
+		return false
+	}
+	return cap(s.ch) == 0 || len(s.ch) < cap(s.ch)
+}
+
+// Pause stops forwarding new batches to the receive channel, until Resume is
+// called.
+func (s *Server) Pause() {
+	s.gate.pause()
+}
+
+// Resume continues forwarding batches after Pause.
+func (s *Server) Resume() {
+	s.gate.resume()
+}
+
 func (s *Server) run() {
 	defer s.sig.Done()
+	defer atomic.StoreInt32(&s.listening, 0)
 
 	for {
 		client, err := s.listener.Accept()
@@ -144,6 +464,11 @@ func (s *Server) run() {
 		}
 
 		log.Printf("New connection from %v", client.RemoteAddr())
+		if !s.admitted && !s.limits.Admit(client) {
+			_ = client.Close()
+			continue
+		}
+		s.opts.SocketBuffers.Apply(client)
 		s.startConnHandler(client)
 	}
 }
@@ -151,9 +476,10 @@ func (s *Server) run() {
 func (s *Server) startConnHandler(client net.Conn) {
 	var wgStart sync.WaitGroup
 
-	h, err := s.opts.Handler(newChanCallback(s.sig.Sig(), s.ch), client)
+	h, err := s.opts.Handler(newChanCallback(s, client), client)
 	if err != nil {
 		log.Printf("Failed to initialize client handler: %v", h)
+		s.limits.ReleaseGoroutines()
 		return
 	}
 
@@ -162,9 +488,19 @@ func (s *Server) startConnHandler(client net.Conn) {
 	stopped := make(chan struct{}, 1)
 	go func() {
 		defer s.sig.Done()
+		defer s.limits.ReleaseGoroutines()
 		defer close(stopped) // signal handler loop stopped
 
 		wgStart.Done()
+		if err := Handshake(client, s.opts.Timeout); err != nil {
+			h.Stop()
+			return
+		}
+		if fn := s.opts.AcceptFunc; fn != nil && !fn(client) {
+			log.Printf("Connection from %v rejected by accept func", client.RemoteAddr())
+			h.Stop()
+			return
+		}
 		h.Run()
 	}()
 
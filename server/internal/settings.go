@@ -0,0 +1,45 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import "time"
+
+// Settings is a read-only snapshot of the effective server configuration,
+// after all options have been applied.
+type Settings struct {
+	// V1 and V2 report the protocol versions enabled.
+	V1, V2 bool
+
+	Timeout     time.Duration
+	Keepalive   time.Duration // protocol version 2 only
+	IdleTimeout time.Duration // protocol version 2 only
+
+	// TLS is set if TLS is enabled. MinTLSVersion is the minimum TLS version
+	// accepted, or 0 if the crypto/tls default is used.
+	TLS           bool
+	MinTLSVersion uint16
+
+	// ChannelSize is the capacity of the receive channel.
+	ChannelSize int
+
+	MaxInFlightBytes        int
+	MaxBatchesPerConnection int
+	MaxHandlerGoroutines    int
+	MaxEvents               int // protocol version 2 only
+	MaxDecompressedSize     int // protocol version 2 only
+}
@@ -0,0 +1,81 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import (
+	"crypto/tls"
+	"net"
+
+	"github.com/elastic/go-lumber/log"
+)
+
+// SocketBuffers configures the kernel socket buffer sizes of accepted TCP
+// connections. Sizes <= 0 keep the operating system defaults.
+type SocketBuffers struct {
+	Send int
+	Recv int
+}
+
+type sockoptListener struct {
+	net.Listener
+	bufs SocketBuffers
+}
+
+// Listen creates a TCP listener applying bufs to accepted connections. The
+// listener is wrapped with TLS if tlsConfig is set.
+func Listen(network, addr string, tlsConfig *tls.Config, bufs SocketBuffers) (net.Listener, error) {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if tlsConfig == nil {
+		// socket options are applied by the accept loop
+		return l, nil
+	}
+	return tls.NewListener(&sockoptListener{l, bufs}, tlsConfig), nil
+}
+
+// Apply sets the socket buffer sizes if c is a TCP connection. Connections of
+// other types, like TLS connections, are not modified.
+func (b SocketBuffers) Apply(c net.Conn) {
+	tcp, ok := c.(*net.TCPConn)
+	if !ok {
+		return
+	}
+
+	if b.Send > 0 {
+		if err := tcp.SetWriteBuffer(b.Send); err != nil {
+			log.Printf("Failed to set send buffer size: %v", err)
+		}
+	}
+	if b.Recv > 0 {
+		if err := tcp.SetReadBuffer(b.Recv); err != nil {
+			log.Printf("Failed to set receive buffer size: %v", err)
+		}
+	}
+}
+
+func (l *sockoptListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.bufs.Apply(c)
+	return c, nil
+}
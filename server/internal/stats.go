@@ -0,0 +1,43 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import "sync/atomic"
+
+// CompressionStats counts the compressed and decompressed bytes of compressed
+// frames received by all connections of a server.
+type CompressionStats struct {
+	compressed   uint64
+	decompressed uint64
+}
+
+// Add records a compressed frame being read.
+func (s *CompressionStats) Add(compressed, decompressed int) {
+	atomic.AddUint64(&s.compressed, uint64(compressed))
+	atomic.AddUint64(&s.decompressed, uint64(decompressed))
+}
+
+// Compressed returns the total payload size of compressed frames.
+func (s *CompressionStats) Compressed() uint64 {
+	return atomic.LoadUint64(&s.compressed)
+}
+
+// Decompressed returns the total number of bytes decompressed.
+func (s *CompressionStats) Decompressed() uint64 {
+	return atomic.LoadUint64(&s.decompressed)
+}
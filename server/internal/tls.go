@@ -0,0 +1,133 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/elastic/go-lumber/log"
+)
+
+// ErrNoCertificate indicates a TLS configuration without any certificate to
+// serve TLS handshakes.
+var ErrNoCertificate = errors.New("TLS config has no server certificate configured")
+
+// ValidateTLS checks a TLS configuration used for serving provides a
+// certificate source. A nil configuration is valid.
+func ValidateTLS(cfg *tls.Config) error {
+	if cfg == nil {
+		return nil
+	}
+
+	hasCert := len(cfg.Certificates) > 0 ||
+		cfg.GetCertificate != nil ||
+		cfg.GetConfigForClient != nil
+	if !hasCert {
+		return ErrNoCertificate
+	}
+	return nil
+}
+
+// ValidateTLSVersion checks v being a known TLS version constant, like
+// tls.VersionTLS12.
+func ValidateTLSVersion(v uint16) error {
+	switch v {
+	case tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13:
+		return nil
+	default:
+		return fmt.Errorf("unknown TLS version 0x%04x", v)
+	}
+}
+
+// WithMinTLSVersion returns a copy of cfg with MinVersion set to v. A new
+// configuration is created if cfg is nil. cfg is returned unchanged if v is
+// 0.
+func WithMinTLSVersion(cfg *tls.Config, v uint16) *tls.Config {
+	if v == 0 {
+		return cfg
+	}
+	if cfg == nil {
+		cfg = &tls.Config{}
+	} else {
+		cfg = cfg.Clone()
+	}
+	cfg.MinVersion = v
+	return cfg
+}
+
+// Handshake runs the TLS handshake if client is a TLS connection, logging
+// failures with the client address. Handshake failures would otherwise only
+// surface as generic read errors. Plaintext lumberjack clients are detected by
+// their first byte and rejected with a dedicated message. A timeout of 0
+// disables the handshake deadline.
+func Handshake(client net.Conn, timeout time.Duration) error {
+	tc, ok := client.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	if timeout > 0 {
+		if err := tc.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return err
+		}
+		defer tc.SetDeadline(time.Time{})
+	}
+
+	if err := tc.Handshake(); err != nil {
+		var rhe tls.RecordHeaderError
+		if errors.As(err, &rhe) && isPlaintextLumberjack(rhe.RecordHeader[0]) {
+			log.Printf("Rejected plaintext connection from %v, TLS is required",
+				client.RemoteAddr())
+		} else {
+			log.Printf("TLS handshake with %v failed: %v", client.RemoteAddr(), err)
+		}
+		return err
+	}
+	return nil
+}
+
+// isPlaintextLumberjack checks if the first byte received on a connection is
+// a lumberjack protocol version.
+func isPlaintextLumberjack(b byte) bool {
+	return b == '1' || b == '2'
+}
+
+// PeerCertFingerprint returns the hex encoded SHA-256 fingerprint of the TLS
+// client's leaf certificate. Returns an empty string if conn does not use
+// TLS or the client did not present a certificate.
+func PeerCertFingerprint(conn net.Conn) string {
+	tc, ok := conn.(interface {
+		ConnectionState() tls.ConnectionState
+	})
+	if !ok {
+		return ""
+	}
+
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(certs[0].Raw)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,164 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-lumber/log"
+)
+
+type recordLogger struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (l *recordLogger) Printf(format string, args ...interface{}) {
+	l.record(fmt.Sprintf(format, args...))
+}
+
+func (l *recordLogger) Println(args ...interface{}) {
+	l.record(fmt.Sprintln(args...))
+}
+
+func (l *recordLogger) Print(args ...interface{}) {
+	l.record(fmt.Sprint(args...))
+}
+
+func (l *recordLogger) record(msg string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.msgs = append(l.msgs, msg)
+}
+
+func (l *recordLogger) messages() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.msgs...)
+}
+
+// tcpPipe returns both ends of a TCP connection on the loopback interface.
+// Unlike net.Pipe, writes are buffered, such that a TLS peer failing the
+// handshake does not block the other peer.
+func tcpPipe(t *testing.T) (client, server net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = l.Accept()
+	if err != nil {
+		client.Close()
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func newTestCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestHandshakeFailureLogsClientAddress(t *testing.T) {
+	cert := newTestCertificate(t)
+	tests := map[string]struct {
+		client   func(net.Conn)
+		expected string
+	}{
+		"plaintext lumberjack client": {
+			client: func(c net.Conn) {
+				c.Write([]byte("2W\x00\x00\x00\x01"))
+			},
+			expected: "Rejected plaintext connection from %v, TLS is required",
+		},
+		"untrusted certificate": {
+			client: func(c net.Conn) {
+				tls.Client(c, &tls.Config{ServerName: "localhost"}).Handshake()
+			},
+			expected: "TLS handshake with %v failed: remote error",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			logger := &recordLogger{}
+			defer func(l log.Logging) { log.Logger = l }(log.Logger)
+			log.Logger = logger
+
+			client, server := tcpPipe(t)
+			defer client.Close()
+			defer server.Close()
+			go test.client(client)
+
+			conn := tls.Server(server, &tls.Config{
+				Certificates: []tls.Certificate{cert},
+			})
+			if err := Handshake(conn, time.Second); err == nil {
+				t.Fatal("expected handshake to fail")
+			}
+
+			expected := fmt.Sprintf(test.expected, client.LocalAddr())
+			msgs := logger.messages()
+			if len(msgs) != 1 || !strings.HasPrefix(msgs[0], expected) {
+				t.Errorf("expected log message %q, got %q", expected, msgs)
+			}
+		})
+	}
+}
+
+func TestHandshakeSkipsPlaintextConnections(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	if err := Handshake(server, time.Second); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
@@ -18,13 +18,21 @@
 package server
 
 import (
+	"crypto/tls"
 	"errors"
 	"net"
+	"sync"
+
+	"github.com/elastic/go-lumber/server/internal"
 )
 
 type muxListener struct {
 	net.Listener
-	ch chan net.Conn
+	ch     chan net.Conn
+	limits *internal.Limits
+
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
 type muxConn struct {
@@ -42,26 +50,69 @@ var (
 	ErrListenerClosed = errors.New("listener closed")
 )
 
-func newMuxListener(l net.Listener) *muxListener {
-	return &muxListener{l, make(chan net.Conn, 1)}
+func newMuxListener(l net.Listener, limits *internal.Limits) *muxListener {
+	return &muxListener{
+		Listener: l,
+		limits:   limits,
+		ch:       make(chan net.Conn, 1),
+		closed:   make(chan struct{}),
+	}
 }
 
 // Accept waits for and returns the next connection to the listener.
 func (l *muxListener) Accept() (net.Conn, error) {
-	conn, ok := <-l.ch
-	if !ok {
+	select {
+	case <-l.closed:
 		return nil, ErrListenerClosed
+	case conn := <-l.ch:
+		return conn, nil
 	}
-	return conn, nil
 }
 
 // Close closes the listener.
 // Any blocked Accept operations will be unblocked and return errors.
 func (l *muxListener) Close() error {
-	close(l.ch)
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
 	return nil
 }
 
+// deliver passes conn to Accept. Returns false if the listener has been
+// closed.
+func (l *muxListener) deliver(conn net.Conn) bool {
+	select {
+	case <-l.closed:
+		return false
+	case l.ch <- conn:
+		return true
+	}
+}
+
+// Label returns the label of the listener conn has been accepted by.
+func (l *muxListener) Label(conn net.Conn) string {
+	return internal.ListenerLabel(l.Listener, conn)
+}
+
+// Limits returns the limits shared by all protocol versions. Connections are
+// admitted against the limits before being delivered.
+func (l *muxListener) Limits() *internal.Limits {
+	return l.limits
+}
+
+// ConnectionState returns the TLS connection state if the multiplexed
+// connection uses TLS.
+func (mc *muxConn) ConnectionState() tls.ConnectionState {
+	c := mc.Conn
+	if vc, ok := c.(*versionConn); ok {
+		c = vc.Conn
+	}
+	if tc, ok := c.(*tls.Conn); ok {
+		return tc.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
+
 func newMuxConn(v byte, c net.Conn) *muxConn {
 	mc := &muxConn{}
 	vc := &versionConn{c, mc, v}
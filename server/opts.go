@@ -21,9 +21,13 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"io"
+	"net"
 	"time"
 
 	"github.com/elastic/go-lumber/lj"
+	"github.com/elastic/go-lumber/server/internal"
+	"github.com/elastic/go-lumber/server/v2"
 )
 
 // Option type for configuring server run options.
@@ -37,6 +41,35 @@ type options struct {
 	v1        bool
 	v2        bool
 	ch        chan *lj.Batch
+
+	maxInFlightBytes      int
+	faultInjector         func(phase string) error
+	ackLatency            func(*lj.Batch, time.Duration)
+	lenientFraming        bool
+	sndBuf                int
+	rcvBuf                int
+	slowBatchThreshold    time.Duration
+	maxBatchesPerConn     int
+	maxDecompressedSize   int
+	maxEvents             int
+	debugACKs             bool
+	timestampField        string
+	eventLag              func(time.Duration)
+	recordTo              io.Writer
+	ackRateLimit          int
+	ackEncoder            func(seq uint32) []byte
+	maxHandlerGoroutines  int
+	deadLetter            func(raw []byte, err error)
+	decrypter             func([]byte) ([]byte, error)
+	minTLSVersion         uint16
+	acceptFunc            func(net.Conn) bool
+	perIPConnRate         int
+	perIPConnBurst        int
+	validate              func(map[string]interface{}) error
+	invalidEvents         v2.InvalidEventPolicy
+	idleTimeout           time.Duration
+	maxFields             int
+	maxEncryptedFrameSize int
 }
 
 type jsonDecoder func([]byte, interface{}) error
@@ -64,7 +97,10 @@ func Timeout(to time.Duration) Option {
 	}
 }
 
-// TLS enables and configures TLS support in lumberjack server.
+// TLS enables and configures TLS support in lumberjack server. The
+// configuration must provide a server certificate via Certificates,
+// GetCertificate or GetConfigForClient. Plaintext connections are rejected
+// with a logged message.
 func TLS(tls *tls.Config) Option {
 	return func(opt *options) error {
 		opt.tls = tls
@@ -106,6 +142,323 @@ func V2(b bool) Option {
 	}
 }
 
+// MaxInFlightBytes limits the total payload size of batches being enqueued,
+// but not yet ACKed. Once the limit is reached, reading new batches from
+// clients is blocked until enough batches have been ACKed. A value of 0
+// disables the limit. If multiple protocol versions are enabled, all versions
+// share the limit.
+func MaxInFlightBytes(n int) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("max in-flight bytes must not be negative")
+		}
+		opt.maxInFlightBytes = n
+		return nil
+	}
+}
+
+// FaultInjector installs a callback for testing client behavior on faulty
+// connections. Faults are injected into protocol version 2 connections only.
+// See v2.FaultInjector for details.
+func FaultInjector(fn func(phase string) error) Option {
+	return func(opt *options) error {
+		opt.faultInjector = fn
+		return nil
+	}
+}
+
+// ACKLatency registers a callback being called with the time passed between
+// a batch being received and the batch being ACKed by the consumer. The
+// callback must not block.
+func ACKLatency(fn func(b *lj.Batch, latency time.Duration)) Option {
+	return func(opt *options) error {
+		opt.ackLatency = fn
+		return nil
+	}
+}
+
+// LenientFraming relaxes the frame ordering expected from protocol version 2
+// clients. See v2.LenientFraming for details.
+func LenientFraming(b bool) Option {
+	return func(opt *options) error {
+		opt.lenientFraming = b
+		return nil
+	}
+}
+
+// SendBufferBytes sets the socket send buffer size of accepted TCP
+// connections. The operating system might round or cap the requested size
+// (e.g. Linux doubles the value and caps it at net.core.wmem_max).
+func SendBufferBytes(n int) Option {
+	return func(opt *options) error {
+		if n <= 0 {
+			return errors.New("send buffer size must be positive")
+		}
+		opt.sndBuf = n
+		return nil
+	}
+}
+
+// RecvBufferBytes sets the socket receive buffer size of accepted TCP
+// connections. The operating system might round or cap the requested size
+// (e.g. Linux doubles the value and caps it at net.core.rmem_max).
+func RecvBufferBytes(n int) Option {
+	return func(opt *options) error {
+		if n <= 0 {
+			return errors.New("receive buffer size must be positive")
+		}
+		opt.rcvBuf = n
+		return nil
+	}
+}
+
+// SlowBatchThreshold enables logging of batches taking longer than d from
+// being received to being ACKed. The log message contains the client address,
+// the number of events and the elapsed time. A value of 0 disables logging.
+func SlowBatchThreshold(d time.Duration) Option {
+	return func(opt *options) error {
+		if d < 0 {
+			return errors.New("slow batch threshold must not be negative")
+		}
+		opt.slowBatchThreshold = d
+		return nil
+	}
+}
+
+// MaxBatchesPerConnection closes client connections after n batches have been
+// received and ACKed, forcing clients to reconnect. This bounds the resources
+// accumulated per connection. A value of 0 disables the limit.
+func MaxBatchesPerConnection(n int) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("max batches per connection must not be negative")
+		}
+		opt.maxBatchesPerConn = n
+		return nil
+	}
+}
+
+// MaxDecompressedSize limits the total size of decompressed payloads per
+// protocol version 2 batch. See v2.MaxDecompressedSize for details.
+func MaxDecompressedSize(n int) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("max decompressed size must not be negative")
+		}
+		opt.maxDecompressedSize = n
+		return nil
+	}
+}
+
+// MaxEvents limits the number of events per protocol version 2 batch. See
+// v2.MaxEvents for details.
+func MaxEvents(n int) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("max events must not be negative")
+		}
+		opt.maxEvents = n
+		return nil
+	}
+}
+
+// DebugACKs enables logging of every ACK frame sent to protocol version 2
+// clients. See v2.DebugACKs for details.
+func DebugACKs(b bool) Option {
+	return func(opt *options) error {
+		opt.debugACKs = b
+		return nil
+	}
+}
+
+// TimestampField enables monitoring of the ingest lag. For every received
+// event, the time passed between the event timestamp and the batch being
+// received is passed to fn. The timestamp is read from the named top-level
+// event field and must be formatted as RFC3339 string. Events without valid
+// timestamp are skipped. The callback must not block.
+func TimestampField(name string, fn func(lag time.Duration)) Option {
+	return func(opt *options) error {
+		if name == "" && fn != nil {
+			return errors.New("timestamp field name must not be empty")
+		}
+		opt.timestampField = name
+		opt.eventLag = fn
+		return nil
+	}
+}
+
+// RecordTo enables recording of all received batches to w. Batches are
+// written as newline delimited JSON (see lj.Record) before being forwarded to
+// the receive channel. Recordings can be replayed with the v2 client's
+// ReplayFrom. Recording is stopped on the first write error.
+func RecordTo(w io.Writer) Option {
+	return func(opt *options) error {
+		opt.recordTo = w
+		return nil
+	}
+}
+
+// ACKRateLimit limits the number of batch ACKs sent to clients per second,
+// across all connections. Intended for simulating slow consumers when testing
+// client backpressure. A value of 0 disables the limit. If multiple protocol
+// versions are enabled, the limit applies per protocol version.
+func ACKRateLimit(perSecond int) Option {
+	return func(opt *options) error {
+		if perSecond < 0 {
+			return errors.New("ack rate limit must not be negative")
+		}
+		opt.ackRateLimit = perSecond
+		return nil
+	}
+}
+
+// ACKEncoder replaces the ACK frame sent to protocol version 2 clients. See
+// v2.ACKEncoder for details.
+func ACKEncoder(fn func(seq uint32) []byte) Option {
+	return func(opt *options) error {
+		opt.ackEncoder = fn
+		return nil
+	}
+}
+
+// MaxHandlerGoroutines limits the number of goroutines spawned for handling
+// client connections. See v2.MaxHandlerGoroutines for details. If multiple
+// protocol versions are enabled, all versions share the limit, which is
+// applied before the TLS handshake and protocol version detection.
+func MaxHandlerGoroutines(n int) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("max handler goroutines must not be negative")
+		}
+		opt.maxHandlerGoroutines = n
+		return nil
+	}
+}
+
+// DeadLetter registers a callback for payloads of protocol version 2 clients
+// failing to be decoded. See v2.DeadLetter for details.
+func DeadLetter(fn func(raw []byte, err error)) Option {
+	return func(opt *options) error {
+		opt.deadLetter = fn
+		return nil
+	}
+}
+
+// PayloadDecrypter decrypts encrypted data frames sent by protocol version 2
+// clients. See v2.PayloadDecrypter for details.
+func PayloadDecrypter(fn func(encrypted []byte) ([]byte, error)) Option {
+	return func(opt *options) error {
+		opt.decrypter = fn
+		return nil
+	}
+}
+
+// MinTLSVersion sets the minimum TLS version accepted from clients, e.g.
+// tls.VersionTLS12. A TLS configuration is created if none has been given via
+// the TLS option, which still must provide a server certificate. The TLS
+// configuration passed to the TLS option is not modified.
+func MinTLSVersion(v uint16) Option {
+	return func(opt *options) error {
+		if err := internal.ValidateTLSVersion(v); err != nil {
+			return err
+		}
+		opt.minTLSVersion = v
+		return nil
+	}
+}
+
+// AcceptFunc registers a callback deciding whether to serve a new client
+// connection. fn is called after the TLS handshake, before any batch is read.
+// If fn returns false, the connection is closed and the rejection is logged.
+// The TLS state of a connection can be accessed by asserting the connection
+// to implement ConnectionState() tls.ConnectionState, which also holds for
+// connections of a server multiplexing protocol versions.
+func AcceptFunc(fn func(conn net.Conn) bool) Option {
+	return func(opt *options) error {
+		opt.acceptFunc = fn
+		return nil
+	}
+}
+
+// PerIPConnRateLimit limits how fast new connections from the same source IP
+// are accepted, using a token bucket per IP refilled with perSecond tokens
+// per second and holding up to burst tokens. Connections exceeding the limit
+// are closed right away, such that a single noisy client can not exhaust the
+// server's connection handling. A rate of 0 disables the limit. If multiple
+// protocol versions are enabled, all versions share the limit, which is
+// applied before the TLS handshake.
+func PerIPConnRateLimit(perSecond, burst int) Option {
+	return func(opt *options) error {
+		if perSecond < 0 {
+			return errors.New("connection rate limit must not be negative")
+		}
+		if perSecond > 0 && burst <= 0 {
+			return errors.New("connection rate burst must be positive")
+		}
+		opt.perIPConnRate = perSecond
+		opt.perIPConnBurst = burst
+		return nil
+	}
+}
+
+// ValidateEvent registers a function validating events of protocol version 2
+// clients. See v2.ValidateEvent for details.
+func ValidateEvent(fn func(evt map[string]interface{}) error) Option {
+	return func(opt *options) error {
+		opt.validate = fn
+		return nil
+	}
+}
+
+// OnInvalidEvent configures the handling of events failing validation. See
+// v2.OnInvalidEvent for details.
+func OnInvalidEvent(p v2.InvalidEventPolicy) Option {
+	return func(opt *options) error {
+		opt.invalidEvents = p
+		return nil
+	}
+}
+
+// IdleTimeout configures a sliding idle timeout for connections of protocol
+// version 2 clients. See v2.IdleTimeout for details.
+func IdleTimeout(d time.Duration) Option {
+	return func(opt *options) error {
+		if d < 0 {
+			return errors.New("idle timeout must not be negative")
+		}
+		opt.idleTimeout = d
+		return nil
+	}
+}
+
+// MaxFieldsPerEvent limits the total number of fields per event of protocol
+// version 2 clients. See v2.MaxFieldsPerEvent for details.
+func MaxFieldsPerEvent(n int) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("max fields per event must not be negative")
+		}
+		opt.maxFields = n
+		return nil
+	}
+}
+
+// MaxEncryptedFrameSize limits the payload size of encrypted frames sent by
+// protocol version 2 clients. See v2.MaxEncryptedFrameSize for details.
+func MaxEncryptedFrameSize(n int) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("max encrypted frame size must not be negative")
+		}
+		opt.maxEncryptedFrameSize = n
+		return nil
+	}
+}
+
+func (o *options) socketBuffers() internal.SocketBuffers {
+	return internal.SocketBuffers{Send: o.sndBuf, Recv: o.rcvBuf}
+}
+
 func applyOptions(opts []Option) (options, error) {
 	o := options{
 		decoder:   json.Unmarshal,
@@ -121,5 +474,31 @@ func applyOptions(opts []Option) (options, error) {
 			return o, err
 		}
 	}
+
+	o.tls = internal.WithMinTLSVersion(o.tls, o.minTLSVersion)
+	if err := internal.ValidateTLS(o.tls); err != nil {
+		return o, err
+	}
 	return o, nil
 }
+
+func (o *options) settings() Settings {
+	st := Settings{
+		V1:          o.v1,
+		V2:          o.v2,
+		Timeout:     o.timeout,
+		Keepalive:   o.keepalive,
+		IdleTimeout: o.idleTimeout,
+		TLS:         o.tls != nil,
+
+		MaxInFlightBytes:        o.maxInFlightBytes,
+		MaxBatchesPerConnection: o.maxBatchesPerConn,
+		MaxHandlerGoroutines:    o.maxHandlerGoroutines,
+		MaxEvents:               o.maxEvents,
+		MaxDecompressedSize:     o.maxDecompressedSize,
+	}
+	if o.tls != nil {
+		st.MinTLSVersion = o.tls.MinVersion
+	}
+	return st
+}
@@ -18,14 +18,18 @@
 package server
 
 import (
-	"crypto/tls"
+	"context"
 	"errors"
 	"io"
 	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/elastic/go-lumber/lj"
 	"github.com/elastic/go-lumber/log"
+	"github.com/elastic/go-lumber/server/internal"
 	"github.com/elastic/go-lumber/server/v1"
 	"github.com/elastic/go-lumber/server/v2"
 )
@@ -45,7 +49,118 @@ type Server interface {
 	Close() error
 }
 
+// The optional interfaces below are implemented by all servers created by
+// this package, including the v1 and v2 servers. Use a type assertion for
+// accessing the functionality from a Server.
+
+// Pauser is implemented by servers supporting pausing the forwarding of
+// batches.
+type Pauser interface {
+	// Pause stops forwarding new batches to the receive channel. Connections
+	// are kept open, but no new batches are read from clients. Batches
+	// already forwarded can still be ACKed, such that ingest can be quiesced
+	// without closing connections. Clients waiting for a paused batch being
+	// ACKed might time out if the server is paused for longer than the client
+	// timeout.
+	Pause()
+
+	// Resume continues forwarding batches to the receive channel after Pause.
+	Resume()
+}
+
+// Shutdowner is implemented by servers supporting graceful shutdown.
+type Shutdowner interface {
+	// Shutdown gracefully shuts down the server. The listener is closed and
+	// no new batches are read from clients, while batches already received
+	// are still forwarded and ACKed. Once all received batches have been
+	// ACKed, the server is closed like Close. If ctx is done first, the server
+	// is closed right away and the context's error is returned.
+	Shutdown(ctx context.Context) error
+
+	// Done returns a channel, which is closed once the server has been
+	// closed.
+	Done() <-chan struct{}
+}
+
+// HealthChecker is implemented by servers reporting their health.
+type HealthChecker interface {
+	// IsHealthy reports whether the server is accepting new connections and
+	// the receive channel has capacity left for new batches. A paused server
+	// is not healthy.
+	IsHealthy() bool
+}
+
+// InFlightTracker is implemented by servers tracking the batches forwarded
+// to the receive channel, which have not been ACKed yet.
+type InFlightTracker interface {
+	// UnACKed returns the batches forwarded to the receive channel, which have
+	// not been ACKed yet, ordered by batch ID. Batches of closed connections
+	// are included, as their clients did not receive an ACK and will resend
+	// the events. The list remains available after Close, for recording
+	// batches being lost on shutdown.
+	UnACKed() []*lj.Batch
+
+	// InFlight returns the number of batches forwarded to the receive
+	// channel, which have not been ACKed yet.
+	InFlight() int
+}
+
+// Addresser is implemented by servers reporting their listener addresses.
+type Addresser interface {
+	// Addr returns the listener's network address.
+	Addr() net.Addr
+
+	// Addrs returns the network addresses of all listeners.
+	Addrs() []net.Addr
+}
+
+// StatsReporter is implemented by servers counting the data received.
+type StatsReporter interface {
+	// EventsReceived returns the total number of events forwarded to the
+	// receive channel.
+	EventsReceived() uint64
+
+	// BatchesReceived returns the total number of batches forwarded to the
+	// receive channel.
+	BatchesReceived() uint64
+
+	// CompressedBytesReceived returns the total payload size of compressed
+	// data frames received.
+	CompressedBytesReceived() uint64
+
+	// DecompressedBytesReceived returns the total number of bytes
+	// decompressed from compressed data frames received. The ratio to
+	// CompressedBytesReceived is the effective compression ratio.
+	DecompressedBytesReceived() uint64
+
+	// EventsRejected returns the total number of events failing validation.
+	// See ValidateEvent.
+	EventsRejected() uint64
+}
+
+// SettingsReporter is implemented by servers reporting their configuration.
+type SettingsReporter interface {
+	// Options returns a snapshot of the effective server configuration.
+	Options() Settings
+}
+
+// versionServer is implemented by all servers created by this package.
+type versionServer interface {
+	Server
+	Pauser
+	Shutdowner
+	HealthChecker
+	InFlightTracker
+	Addresser
+	StatsReporter
+	SettingsReporter
+}
+
+var _ versionServer = (*server)(nil)
+
 type server struct {
+	listening int32 // set to 1 while accept loop is active
+
 	ch    chan *lj.Batch
 	ownCH bool
 
@@ -54,18 +169,34 @@ type server struct {
 
 	netListener net.Listener
 	mux         []muxServer
+	limits      *internal.Limits
+	bufs        internal.SocketBuffers
+	timeout     time.Duration
+	settings    Settings
+
+	listenerOnce sync.Once
+	listenerErr  error
+	closeOnce    sync.Once
+	closeErr     error
 }
 
+// Settings is a read-only snapshot of the effective server configuration.
+type Settings = internal.Settings
+
 type muxServer struct {
 	mux    byte
 	l      *muxListener
-	server Server
+	server versionServer
 }
 
 var (
 	// ErrNoVersionEnabled indicates no lumberjack protocol version being enabled
 	// when instantiating a server.
 	ErrNoVersionEnabled = errors.New("No protocol version enabled")
+
+	// ErrNoCertificate is returned if the TLS configuration has no server
+	// certificate configured.
+	ErrNoCertificate = internal.ErrNoCertificate
 )
 
 // NewWithListener creates a new Server using an existing net.Listener. Use
@@ -74,6 +205,24 @@ func NewWithListener(l net.Listener, opts ...Option) (Server, error) {
 	return newServer(l, opts...)
 }
 
+// NewWithListeners creates a new Server accepting connections from multiple
+// listeners. All listeners feed the same receive channel. Closing the server
+// closes all listeners.
+// Use options V1 and V2 to enable wanted protocol versions.
+func NewWithListeners(ls []net.Listener, opts ...Option) (Server, error) {
+	if len(ls) == 0 {
+		return nil, errors.New("no listener given")
+	}
+	return newServer(internal.NewMultiListener(ls), opts...)
+}
+
+// LabelListener labels l, such that batches received on connections
+// accepted by l have lj.Batch.Listener set to label. Use with
+// NewWithListeners for applying per listener policies downstream.
+func LabelListener(l net.Listener, label string) net.Listener {
+	return internal.NewLabeledListener(l, label)
+}
+
 // ListenAndServeWith uses binder to create a listener for establishing a lumberjack
 // endpoint.
 // Use options V1 and V2 to enable wanted protocol versions.
@@ -102,31 +251,183 @@ func ListenAndServe(addr string, opts ...Option) (Server, error) {
 		return nil, err
 	}
 
-	binder := net.Listen
-	if o.tls != nil {
-		binder = func(network, addr string) (net.Listener, error) {
-			return tls.Listen(network, addr, o.tls)
+	binder := func(network, addr string) (net.Listener, error) {
+		return internal.Listen(network, addr, o.tls, o.socketBuffers())
+	}
+	return ListenAndServeWith(binder, addr, opts...)
+}
+
+// ListenAndServeOn listens on all TCP network addresses given, handling batch
+// requests from accepted lumberjack clients with a single server instance.
+// Use options V1 and V2 to enable wanted protocol versions.
+func ListenAndServeOn(addrs []string, opts ...Option) (Server, error) {
+	o, err := applyOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	ls := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		l, err := internal.Listen("tcp", addr, o.tls, o.socketBuffers())
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, err
 		}
+		ls = append(ls, l)
 	}
 
-	return ListenAndServeWith(binder, addr, opts...)
+	s, err := NewWithListeners(ls, opts...)
+	if err != nil {
+		for _, l := range ls {
+			l.Close()
+		}
+	}
+	return s, err
+}
+
+// ListenAndServeContext listens on the TCP network address addr and handles
+// batch requests from accepted lumberjack clients. The server is shut down
+// gracefully once ctx is cancelled, see Shutdowner. The server is closed if
+// pending batches have not been ACKed within 30 seconds.
+// Use options V1 and V2 to enable wanted protocol versions.
+func ListenAndServeContext(ctx context.Context, addr string, opts ...Option) (Server, error) {
+	s, err := ListenAndServe(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := s.(versionServer)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = internal.ShutdownWithTimeout(srv, internal.ShutdownTimeout)
+		case <-srv.Done():
+		}
+	}()
+	return s, nil
 }
 
 // Close stops the listener, closes all active connections and closes the
 // receiver channel returned from ReceiveChan()
 func (s *server) Close() error {
-	close(s.done)
+	s.closeOnce.Do(func() {
+		close(s.done)
+		for _, m := range s.mux {
+			m.server.Close()
+		}
+		s.closeErr = s.closeListener()
+		s.wg.Wait()
+		if s.ownCH {
+			close(s.ch)
+		}
+	})
+	return s.closeErr
+}
+
+// Done returns a channel, which is closed once the server has been closed.
+func (s *server) Done() <-chan struct{} {
+	return s.done
+}
+
+// Shutdown gracefully shuts down all protocol version servers in parallel,
+// before closing the server. See Shutdowner for details.
+func (s *server) Shutdown(ctx context.Context) error {
+	_ = s.closeListener()
+
+	errs := make(chan error, len(s.mux))
 	for _, m := range s.mux {
-		m.server.Close()
+		go func(srv versionServer) {
+			errs <- srv.Shutdown(ctx)
+		}(m.server)
 	}
-	err := s.netListener.Close()
-	s.wg.Wait()
-	if s.ownCH {
-		close(s.ch)
+
+	var err error
+	for range s.mux {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	if cerr := s.Close(); err == nil {
+		err = cerr
 	}
 	return err
 }
 
+func (s *server) closeListener() error {
+	s.listenerOnce.Do(func() {
+		s.listenerErr = s.netListener.Close()
+	})
+	return s.listenerErr
+}
+
+// Addr returns the listener's network address.
+func (s *server) Addr() net.Addr {
+	return s.netListener.Addr()
+}
+
+// Addrs returns the network addresses of all listeners.
+func (s *server) Addrs() []net.Addr {
+	return internal.ListenerAddrs(s.netListener)
+}
+
+// EventsReceived returns the total number of events forwarded to the receive
+// channel.
+func (s *server) EventsReceived() uint64 {
+	var n uint64
+	for _, m := range s.mux {
+		n += m.server.EventsReceived()
+	}
+	return n
+}
+
+// BatchesReceived returns the total number of batches forwarded to the
+// receive channel.
+func (s *server) BatchesReceived() uint64 {
+	var n uint64
+	for _, m := range s.mux {
+		n += m.server.BatchesReceived()
+	}
+	return n
+}
+
+// Options returns a snapshot of the effective server configuration.
+func (s *server) Options() Settings {
+	st := s.settings
+	st.ChannelSize = cap(s.ch)
+	return st
+}
+
+// EventsRejected returns the total number of events failing validation.
+func (s *server) EventsRejected() uint64 {
+	var n uint64
+	for _, m := range s.mux {
+		n += m.server.EventsRejected()
+	}
+	return n
+}
+
+// CompressedBytesReceived returns the total payload size of compressed data
+// frames received.
+func (s *server) CompressedBytesReceived() uint64 {
+	var n uint64
+	for _, m := range s.mux {
+		n += m.server.CompressedBytesReceived()
+	}
+	return n
+}
+
+// DecompressedBytesReceived returns the total number of bytes decompressed
+// from compressed data frames received.
+func (s *server) DecompressedBytesReceived() uint64 {
+	var n uint64
+	for _, m := range s.mux {
+		n += m.server.DecompressedBytesReceived()
+	}
+	return n
+}
+
 // ReceiveChan returns a channel all received batch requests will be made
 // available on. Batches read from channel must be ACKed.
 func (s *server) ReceiveChan() <-chan *lj.Batch {
@@ -144,33 +445,148 @@ func (s *server) Receive() *lj.Batch {
 	}
 }
 
+// UnACKed returns the batches forwarded to the receive channel, which have not
+// been ACKed yet, ordered by batch ID. Batches of closed connections are
+// included, as their clients did not receive an ACK and will resend the
+// events. The list remains available after Close, for recording batches
+// being lost on shutdown.
+func (s *server) UnACKed() []*lj.Batch {
+	var batches []*lj.Batch
+	for _, m := range s.mux {
+		batches = append(batches, m.server.UnACKed()...)
+	}
+	sort.Slice(batches, func(i, j int) bool { return batches[i].ID < batches[j].ID })
+	return batches
+}
+
+// Pause stops forwarding new batches to the receive channel. See
+// Pauser for details.
+func (s *server) Pause() {
+	for _, m := range s.mux {
+		m.server.Pause()
+	}
+}
+
+// Resume continues forwarding batches to the receive channel after Pause.
+func (s *server) Resume() {
+	for _, m := range s.mux {
+		m.server.Resume()
+	}
+}
+
+// InFlight returns the number of batches forwarded to the receive channel,
+// which have not been ACKed yet.
+func (s *server) InFlight() int {
+	n := 0
+	for _, m := range s.mux {
+		n += m.server.InFlight()
+	}
+	return n
+}
+
+// IsHealthy reports whether the server is accepting new connections and the
+// receive channel has capacity left for new batches. A paused server is not
+// healthy.
+func (s *server) IsHealthy() bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+
+	if atomic.LoadInt32(&s.listening) == 0 {
+		return false
+	}
+	for _, m := range s.mux {
+		if !m.server.IsHealthy() {
+			return false
+		}
+	}
+	return cap(s.ch) == 0 || len(s.ch) < cap(s.ch)
+}
+
 func newServer(l net.Listener, opts ...Option) (Server, error) {
 	cfg, err := applyOptions(opts)
 	if err != nil {
 		return nil, err
 	}
+	if cfg.recordTo != nil {
+		// recording is shared by all protocol versions
+		cfg.recordTo = internal.LockedWriter(cfg.recordTo)
+	}
 
-	var servers []func(net.Listener) (Server, byte, error)
+	var servers []func(net.Listener) (versionServer, byte, error)
 
 	log.Printf("Server config: %#v", cfg)
 
 	if cfg.v1 {
-		servers = append(servers, func(l net.Listener) (Server, byte, error) {
-			s, err := v1.NewWithListener(l,
+		servers = append(servers, func(l net.Listener) (versionServer, byte, error) {
+			opts := []v1.Option{
 				v1.Timeout(cfg.timeout),
 				v1.Channel(cfg.ch),
-				v1.TLS(cfg.tls))
+				v1.TLS(cfg.tls),
+				v1.MaxInFlightBytes(cfg.maxInFlightBytes),
+				v1.ACKLatency(cfg.ackLatency),
+				v1.SlowBatchThreshold(cfg.slowBatchThreshold),
+				v1.MaxBatchesPerConnection(cfg.maxBatchesPerConn),
+				v1.TimestampField(cfg.timestampField, cfg.eventLag),
+				v1.RecordTo(cfg.recordTo),
+				v1.ACKRateLimit(cfg.ackRateLimit),
+				v1.MaxHandlerGoroutines(cfg.maxHandlerGoroutines),
+				v1.AcceptFunc(cfg.acceptFunc),
+				v1.PerIPConnRateLimit(cfg.perIPConnRate, cfg.perIPConnBurst),
+			}
+			if cfg.sndBuf > 0 {
+				opts = append(opts, v1.SendBufferBytes(cfg.sndBuf))
+			}
+			if cfg.rcvBuf > 0 {
+				opts = append(opts, v1.RecvBufferBytes(cfg.rcvBuf))
+			}
+
+			s, err := v1.NewWithListener(l, opts...)
 			return s, '1', err
 		})
 	}
 	if cfg.v2 {
-		servers = append(servers, func(l net.Listener) (Server, byte, error) {
-			s, err := v2.NewWithListener(l,
+		servers = append(servers, func(l net.Listener) (versionServer, byte, error) {
+			opts := []v2.Option{
 				v2.Keepalive(cfg.keepalive),
 				v2.Timeout(cfg.timeout),
+				v2.IdleTimeout(cfg.idleTimeout),
 				v2.Channel(cfg.ch),
 				v2.TLS(cfg.tls),
-				v2.JSONDecoder(cfg.decoder))
+				v2.JSONDecoder(cfg.decoder),
+				v2.MaxInFlightBytes(cfg.maxInFlightBytes),
+				v2.FaultInjector(cfg.faultInjector),
+				v2.ACKLatency(cfg.ackLatency),
+				v2.LenientFraming(cfg.lenientFraming),
+				v2.SlowBatchThreshold(cfg.slowBatchThreshold),
+				v2.MaxBatchesPerConnection(cfg.maxBatchesPerConn),
+				v2.TimestampField(cfg.timestampField, cfg.eventLag),
+				v2.RecordTo(cfg.recordTo),
+				v2.ACKRateLimit(cfg.ackRateLimit),
+				v2.MaxHandlerGoroutines(cfg.maxHandlerGoroutines),
+				v2.AcceptFunc(cfg.acceptFunc),
+				v2.PerIPConnRateLimit(cfg.perIPConnRate, cfg.perIPConnBurst),
+				v2.MaxDecompressedSize(cfg.maxDecompressedSize),
+				v2.MaxEvents(cfg.maxEvents),
+				v2.DebugACKs(cfg.debugACKs),
+				v2.ACKEncoder(cfg.ackEncoder),
+				v2.DeadLetter(cfg.deadLetter),
+				v2.PayloadDecrypter(cfg.decrypter),
+				v2.MaxEncryptedFrameSize(cfg.maxEncryptedFrameSize),
+				v2.ValidateEvent(cfg.validate),
+				v2.OnInvalidEvent(cfg.invalidEvents),
+				v2.MaxFieldsPerEvent(cfg.maxFields),
+			}
+			if cfg.sndBuf > 0 {
+				opts = append(opts, v2.SendBufferBytes(cfg.sndBuf))
+			}
+			if cfg.rcvBuf > 0 {
+				opts = append(opts, v2.RecvBufferBytes(cfg.rcvBuf))
+			}
+
+			s, err := v2.NewWithListener(l, opts...)
 			return s, '2', err
 		})
 	}
@@ -189,9 +605,18 @@ func newServer(l net.Listener, opts ...Option) (Server, error) {
 		cfg.ch = make(chan *lj.Batch, 128)
 	}
 
+	// limits are shared by all protocol versions. Connections are admitted
+	// before the protocol version is known.
+	limits := internal.NewLimits(internal.Config{
+		MaxInFlightBytes:     cfg.maxInFlightBytes,
+		MaxHandlerGoroutines: cfg.maxHandlerGoroutines,
+		PerIPConnRate:        cfg.perIPConnRate,
+		PerIPConnBurst:       cfg.perIPConnBurst,
+	})
+
 	mux := make([]muxServer, len(servers))
 	for i, mk := range servers {
-		muxL := newMuxListener(l)
+		muxL := newMuxListener(l, limits)
 		log.Printf("mk: %v", i)
 		s, b, err := mk(muxL)
 		if err != nil {
@@ -210,8 +635,13 @@ func newServer(l net.Listener, opts ...Option) (Server, error) {
 		ownCH:       ownCH,
 		netListener: l,
 		mux:         mux,
+		limits:      limits,
+		bufs:        cfg.socketBuffers(),
+		timeout:     cfg.timeout,
+		settings:    cfg.settings(),
 		done:        make(chan struct{}),
 	}
+	atomic.StoreInt32(&s.listening, 1)
 	s.wg.Add(1)
 	go s.run()
 
@@ -220,40 +650,33 @@ func newServer(l net.Listener, opts ...Option) (Server, error) {
 
 func (s *server) run() {
 	defer s.wg.Done()
+	defer atomic.StoreInt32(&s.listening, 0)
 	for {
 		client, err := s.netListener.Accept()
 		if err != nil {
 			break
 		}
 
+		if !s.limits.Admit(client) {
+			_ = client.Close()
+			continue
+		}
+
+		s.bufs.Apply(client)
 		s.handle(client)
 	}
 }
 
 func (s *server) handle(client net.Conn) {
-	// read first byte and decide multiplexer
-
 	sig := make(chan struct{})
 
 	go func() {
 		defer close(sig)
 
-		var buf [1]byte
-		if _, err := io.ReadFull(client, buf[:]); err != nil {
+		if !s.dispatch(client) {
 			client.Close()
-			return
-		}
-
-		for _, m := range s.mux {
-			if m.mux != buf[0] {
-				continue
-			}
-
-			conn := newMuxConn(buf[0], client)
-			m.l.ch <- conn
-			return
+			s.limits.ReleaseGoroutines()
 		}
-		client.Close()
 	}()
 
 	go func() {
@@ -265,3 +688,24 @@ func (s *server) handle(client net.Conn) {
 		}
 	}()
 }
+
+// dispatch reads the first byte of client and delivers the connection to the
+// protocol version's listener. Returns false if the connection has not been
+// delivered.
+func (s *server) dispatch(client net.Conn) bool {
+	if err := internal.Handshake(client, s.timeout); err != nil {
+		return false
+	}
+
+	var buf [1]byte
+	if _, err := io.ReadFull(client, buf[:]); err != nil {
+		return false
+	}
+
+	for _, m := range s.mux {
+		if m.mux == buf[0] {
+			return m.l.deliver(newMuxConn(buf[0], client))
+		}
+	}
+	return false
+}
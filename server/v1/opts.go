@@ -20,9 +20,12 @@ package v1
 import (
 	"crypto/tls"
 	"errors"
+	"io"
+	"net"
 	"time"
 
 	"github.com/elastic/go-lumber/lj"
+	"github.com/elastic/go-lumber/server/internal"
 )
 
 // Option type for configuring server run options.
@@ -32,6 +35,22 @@ type options struct {
 	timeout time.Duration
 	tls     *tls.Config
 	ch      chan *lj.Batch
+
+	maxInFlightBytes     int
+	ackLatency           func(*lj.Batch, time.Duration)
+	sndBuf               int
+	rcvBuf               int
+	slowBatchThreshold   time.Duration
+	maxBatchesPerConn    int
+	timestampField       string
+	eventLag             func(time.Duration)
+	recordTo             io.Writer
+	ackRateLimit         int
+	maxHandlerGoroutines int
+	minTLSVersion        uint16
+	acceptFunc           func(net.Conn) bool
+	perIPConnRate        int
+	perIPConnBurst       int
 }
 
 // Timeout configures server network timeouts.
@@ -45,7 +64,10 @@ func Timeout(to time.Duration) Option {
 	}
 }
 
-// TLS enables and configures TLS support in lumberjack server.
+// TLS enables and configures TLS support in lumberjack server. The
+// configuration must provide a server certificate via Certificates,
+// GetCertificate or GetConfigForClient. Plaintext connections are rejected
+// with a logged message.
 // Protocol version 1 mandates TLS being enabled.
 func TLS(tls *tls.Config) Option {
 	return func(opt *options) error {
@@ -63,6 +85,184 @@ func Channel(c chan *lj.Batch) Option {
 	}
 }
 
+// MaxInFlightBytes limits the total payload size of batches being enqueued,
+// but not yet ACKed. Once the limit is reached, reading new batches from
+// clients is blocked until enough batches have been ACKed. A value of 0
+// disables the limit.
+func MaxInFlightBytes(n int) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("max in-flight bytes must not be negative")
+		}
+		opt.maxInFlightBytes = n
+		return nil
+	}
+}
+
+// ACKLatency registers a callback being called with the time passed between
+// a batch being received and the batch being ACKed by the consumer. The
+// callback must not block.
+func ACKLatency(fn func(b *lj.Batch, latency time.Duration)) Option {
+	return func(opt *options) error {
+		opt.ackLatency = fn
+		return nil
+	}
+}
+
+// SendBufferBytes sets the socket send buffer size of accepted TCP
+// connections. The operating system might round or cap the requested size
+// (e.g. Linux doubles the value and caps it at net.core.wmem_max).
+func SendBufferBytes(n int) Option {
+	return func(opt *options) error {
+		if n <= 0 {
+			return errors.New("send buffer size must be positive")
+		}
+		opt.sndBuf = n
+		return nil
+	}
+}
+
+// RecvBufferBytes sets the socket receive buffer size of accepted TCP
+// connections. The operating system might round or cap the requested size
+// (e.g. Linux doubles the value and caps it at net.core.rmem_max).
+func RecvBufferBytes(n int) Option {
+	return func(opt *options) error {
+		if n <= 0 {
+			return errors.New("receive buffer size must be positive")
+		}
+		opt.rcvBuf = n
+		return nil
+	}
+}
+
+// SlowBatchThreshold enables logging of batches taking longer than d from
+// being received to being ACKed. The log message contains the client address,
+// the number of events and the elapsed time. A value of 0 disables logging.
+func SlowBatchThreshold(d time.Duration) Option {
+	return func(opt *options) error {
+		if d < 0 {
+			return errors.New("slow batch threshold must not be negative")
+		}
+		opt.slowBatchThreshold = d
+		return nil
+	}
+}
+
+// MaxBatchesPerConnection closes client connections after n batches have been
+// received and ACKed, forcing clients to reconnect. This bounds the resources
+// accumulated per connection. A value of 0 disables the limit.
+func MaxBatchesPerConnection(n int) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("max batches per connection must not be negative")
+		}
+		opt.maxBatchesPerConn = n
+		return nil
+	}
+}
+
+// TimestampField enables monitoring of the ingest lag. For every received
+// event, the time passed between the event timestamp and the batch being
+// received is passed to fn. The timestamp is read from the named top-level
+// event field and must be formatted as RFC3339 string. Events without valid
+// timestamp are skipped. The callback must not block.
+func TimestampField(name string, fn func(lag time.Duration)) Option {
+	return func(opt *options) error {
+		if name == "" && fn != nil {
+			return errors.New("timestamp field name must not be empty")
+		}
+		opt.timestampField = name
+		opt.eventLag = fn
+		return nil
+	}
+}
+
+// RecordTo enables recording of all received batches to w. Batches are
+// written as newline delimited JSON (see lj.Record) before being forwarded to
+// the receive channel. Recordings can be replayed with the v2 client's
+// ReplayFrom. Recording is stopped on the first write error.
+func RecordTo(w io.Writer) Option {
+	return func(opt *options) error {
+		opt.recordTo = w
+		return nil
+	}
+}
+
+// ACKRateLimit limits the number of batch ACKs sent to clients per second,
+// across all connections. Intended for simulating slow consumers when testing
+// client backpressure. A value of 0 disables the limit.
+func ACKRateLimit(perSecond int) Option {
+	return func(opt *options) error {
+		if perSecond < 0 {
+			return errors.New("ack rate limit must not be negative")
+		}
+		opt.ackRateLimit = perSecond
+		return nil
+	}
+}
+
+// MaxHandlerGoroutines limits the number of goroutines spawned for handling
+// client connections. Every connection accounts for the goroutines reading
+// batches, writing ACKs and watching for server shutdown. Connections
+// accepted while the budget is exhausted are closed right away, as lumberjack
+// has no way to report the server being busy. Clients are expected to
+// reconnect with backoff. A value of 0 disables the limit.
+func MaxHandlerGoroutines(n int) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("max handler goroutines must not be negative")
+		}
+		opt.maxHandlerGoroutines = n
+		return nil
+	}
+}
+
+// MinTLSVersion sets the minimum TLS version accepted from clients, e.g.
+// tls.VersionTLS12. A TLS configuration is created if none has been given via
+// the TLS option, which still must provide a server certificate. The TLS
+// configuration passed to the TLS option is not modified.
+func MinTLSVersion(v uint16) Option {
+	return func(opt *options) error {
+		if err := internal.ValidateTLSVersion(v); err != nil {
+			return err
+		}
+		opt.minTLSVersion = v
+		return nil
+	}
+}
+
+// AcceptFunc registers a callback deciding whether to serve a new client
+// connection. fn is called after the TLS handshake, before any batch is read.
+// If fn returns false, the connection is closed and the rejection is logged.
+// The TLS state of a connection can be accessed by asserting the connection
+// to implement ConnectionState() tls.ConnectionState, which also holds for
+// connections of a server multiplexing protocol versions.
+func AcceptFunc(fn func(conn net.Conn) bool) Option {
+	return func(opt *options) error {
+		opt.acceptFunc = fn
+		return nil
+	}
+}
+
+// PerIPConnRateLimit limits how fast new connections from the same source IP
+// are accepted, using a token bucket per IP refilled with perSecond tokens
+// per second and holding up to burst tokens. Connections exceeding the limit
+// are closed right away, such that a single noisy client can not exhaust the
+// server's connection handling. A rate of 0 disables the limit.
+func PerIPConnRateLimit(perSecond, burst int) Option {
+	return func(opt *options) error {
+		if perSecond < 0 {
+			return errors.New("connection rate limit must not be negative")
+		}
+		if perSecond > 0 && burst <= 0 {
+			return errors.New("connection rate burst must be positive")
+		}
+		opt.perIPConnRate = perSecond
+		opt.perIPConnBurst = burst
+		return nil
+	}
+}
+
 func applyOptions(opts []Option) (options, error) {
 	o := options{
 		timeout: 30 * time.Second,
@@ -74,5 +274,26 @@ func applyOptions(opts []Option) (options, error) {
 			return o, err
 		}
 	}
+
+	o.tls = internal.WithMinTLSVersion(o.tls, o.minTLSVersion)
+	if err := internal.ValidateTLS(o.tls); err != nil {
+		return o, err
+	}
 	return o, nil
 }
+
+func (o *options) settings() Settings {
+	st := Settings{
+		V1:      true,
+		Timeout: o.timeout,
+		TLS:     o.tls != nil,
+
+		MaxInFlightBytes:        o.maxInFlightBytes,
+		MaxBatchesPerConnection: o.maxBatchesPerConn,
+		MaxHandlerGoroutines:    o.maxHandlerGoroutines,
+	}
+	if o.tls != nil {
+		st.MinTLSVersion = o.tls.MinVersion
+	}
+	return st
+}
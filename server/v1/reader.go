@@ -29,21 +29,25 @@ import (
 	"github.com/elastic/go-lumber/lj"
 	"github.com/elastic/go-lumber/log"
 	protocol "github.com/elastic/go-lumber/protocol/v1"
+	"github.com/elastic/go-lumber/server/internal"
 )
 
 type reader struct {
 	in      *bufio.Reader
 	conn    net.Conn
 	timeout time.Duration
+	size    int
 	buf     []byte
+	stats   *internal.CompressionStats
 }
 
-func newReader(c net.Conn, to time.Duration) *reader {
+func newReader(c net.Conn, to time.Duration, stats *internal.CompressionStats) *reader {
 	r := &reader{
 		in:      bufio.NewReader(c),
 		conn:    c,
 		timeout: to,
 		buf:     make([]byte, 0, 64),
+		stats:   stats,
 	}
 	return r
 }
@@ -70,13 +74,14 @@ func (r *reader) ReadBatch() (*lj.Batch, error) {
 		return nil, err
 	}
 
+	r.size = 0
 	events, err := r.readEvents(r.in, make([]interface{}, 0, count))
 	if events == nil || err != nil {
 		log.Printf("readEvents failed with: %v", err)
 		return nil, err
 	}
 
-	return lj.NewBatch(events), nil
+	return lj.NewBatchWithSize(events, r.size), nil
 }
 
 func (r *reader) readEvents(in io.Reader, events []interface{}) ([]interface{}, error) {
@@ -127,7 +132,8 @@ func (r *reader) readCompressed(in io.Reader, events []interface{}) ([]interface
 		return nil, err
 	}
 
-	events, err = r.readEvents(reader, events)
+	payload := &countReader{in: reader}
+	events, err = r.readEvents(payload, events)
 	if err != nil {
 		_ = reader.Close()
 		return nil, err
@@ -146,9 +152,23 @@ func (r *reader) readCompressed(in io.Reader, events []interface{}) ([]interface
 			break
 		}
 	}
+
+	r.stats.Add(int(payloadSz), payload.n)
 	return events, nil
 }
 
+// countReader counts the bytes read from in.
+type countReader struct {
+	in io.Reader
+	n  int
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.in.Read(p)
+	c.n += n
+	return n, err
+}
+
 func (r *reader) readEvent(in io.Reader) (interface{}, error) {
 	var hdr [8]byte
 	if err := readFull(in, hdr[:]); err != nil {
@@ -170,6 +190,7 @@ func (r *reader) readEvent(in io.Reader) (interface{}, error) {
 		if err := readFull(in, buf); err != nil {
 			return "", err
 		}
+		r.size += bytes
 
 		return string(buf[:]), nil
 	}
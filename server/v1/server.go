@@ -18,6 +18,7 @@
 package v1
 
 import (
+	"context"
 	"errors"
 	"net"
 
@@ -25,15 +26,24 @@ import (
 	"github.com/elastic/go-lumber/server/internal"
 )
 
+// Settings is a read-only snapshot of the effective server configuration.
+type Settings = internal.Settings
+
 // Server serves multiple lumberjack clients supporting protocol version 1.
 type Server struct {
-	s *internal.Server
+	s        *internal.Server
+	stats    *internal.CompressionStats
+	settings Settings
 }
 
 var (
 	// ErrProtocolError is returned if an protocol error was detected in the
 	// conversation with lumberjack server.
 	ErrProtocolError = errors.New("lumberjack protocol error")
+
+	// ErrNoCertificate is returned if the TLS configuration has no server
+	// certificate configured.
+	ErrNoCertificate = internal.ErrNoCertificate
 )
 
 // NewWithListener creates a new Server using an existing net.Listener.
@@ -63,6 +73,64 @@ func ListenAndServe(addr string, opts ...Option) (*Server, error) {
 	})
 }
 
+// ListenAndServeContext listens on the TCP network address addr and handles
+// batch requests from accepted lumberjack clients. The server is shut down
+// gracefully once ctx is cancelled, see Shutdown. The server is closed if
+// pending batches have not been ACKed within 30 seconds.
+func ListenAndServeContext(ctx context.Context, addr string, opts ...Option) (*Server, error) {
+	return newServer(opts, func(cfg internal.Config) (*internal.Server, error) {
+		return internal.ListenAndServeContext(ctx, addr, cfg)
+	})
+}
+
+// Addr returns the listener's network address.
+func (s *Server) Addr() net.Addr {
+	return s.s.Addr()
+}
+
+// Addrs returns the network addresses of all listeners.
+func (s *Server) Addrs() []net.Addr {
+	return s.s.Addrs()
+}
+
+// EventsReceived returns the total number of events forwarded to the receive
+// channel.
+func (s *Server) EventsReceived() uint64 {
+	return s.s.EventsReceived()
+}
+
+// BatchesReceived returns the total number of batches forwarded to the
+// receive channel.
+func (s *Server) BatchesReceived() uint64 {
+	return s.s.BatchesReceived()
+}
+
+// CompressedBytesReceived returns the total payload size of compressed data
+// frames received. Together with DecompressedBytesReceived, the effective
+// compression ratio of received frames can be computed.
+func (s *Server) CompressedBytesReceived() uint64 {
+	return s.stats.Compressed()
+}
+
+// DecompressedBytesReceived returns the total number of bytes decompressed
+// from compressed data frames received.
+func (s *Server) DecompressedBytesReceived() uint64 {
+	return s.stats.Decompressed()
+}
+
+// EventsRejected always returns 0, as events of protocol version 1 are not
+// validated.
+func (s *Server) EventsRejected() uint64 {
+	return 0
+}
+
+// Options returns a snapshot of the effective server configuration.
+func (s *Server) Options() Settings {
+	st := s.settings
+	st.ChannelSize = cap(s.s.ReceiveChan())
+	return st
+}
+
 // ReceiveChan returns a channel all received batch requests will be made
 // available on. Batches read from channel must be ACKed.
 func (s *Server) ReceiveChan() <-chan *lj.Batch {
@@ -75,12 +143,65 @@ func (s *Server) Receive() *lj.Batch {
 	return s.s.Receive()
 }
 
+// UnACKed returns the batches forwarded to the receive channel, which have not
+// been ACKed yet, ordered by batch ID. Batches of closed connections are
+// included, as their clients did not receive an ACK and will resend the
+// events. The list remains available after Close, for recording batches
+// being lost on shutdown.
+func (s *Server) UnACKed() []*lj.Batch {
+	return s.s.UnACKed()
+}
+
+// InFlight returns the number of batches forwarded to the receive channel,
+// which have not been ACKed yet. Equals len(UnACKed()), without copying the
+// batches.
+func (s *Server) InFlight() int {
+	return s.s.InFlight()
+}
+
+// IsHealthy reports whether the server is accepting new connections and the
+// receive channel has capacity left for new batches. A paused server is not
+// healthy.
+func (s *Server) IsHealthy() bool {
+	return s.s.IsHealthy()
+}
+
+// Pause stops forwarding new batches to the receive channel. Connections are
+// kept open, but no new batches are read from clients. Batches already
+// forwarded can still be ACKed, such that ingest can be quiesced without
+// closing connections. Clients waiting for a paused batch being ACKed might
+// time out if the server is paused for longer than the client timeout.
+func (s *Server) Pause() {
+	s.s.Pause()
+}
+
+// Resume continues forwarding batches to the receive channel after Pause.
+func (s *Server) Resume() {
+	s.s.Resume()
+}
+
+// Shutdown gracefully shuts down the server. The listener is closed and no
+// new batches are read from clients, while batches already received are
+// still forwarded and ACKed. Once all received batches have been ACKed, the
+// server is closed like Close. If ctx is done first, the server is closed
+// right away and the context's error is returned. Calling Resume during
+// Shutdown continues reading new batches.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.s.Shutdown(ctx)
+}
+
 // Close stops the listener, closes all active connections and closes the
-// receiver channel returned from ReceiveChan().
+// receiver channel returned from ReceiveChan(). Calling Close multiple times
+// is safe.
 func (s *Server) Close() error {
 	return s.s.Close()
 }
 
+// Done returns a channel, which is closed once the server has been closed.
+func (s *Server) Done() <-chan struct{} {
+	return s.s.Done()
+}
+
 func newServer(
 	opts []Option,
 	mk func(cfg internal.Config) (*internal.Server, error),
@@ -90,8 +211,9 @@ func newServer(
 		return nil, err
 	}
 
+	stats := &internal.CompressionStats{}
 	mkRW := func(client net.Conn) (internal.BatchReader, internal.ACKWriter, error) {
-		r := newReader(client, o.timeout)
+		r := newReader(client, o.timeout, stats)
 		w := newWriter(client, o.timeout)
 		return r, w, nil
 	}
@@ -100,8 +222,24 @@ func newServer(
 		TLS:     o.tls,
 		Handler: internal.DefaultHandler(0, mkRW),
 		Channel: o.ch,
+		Timeout: o.timeout,
+
+		MaxInFlightBytes:   o.maxInFlightBytes,
+		ACKLatency:         o.ackLatency,
+		SocketBuffers:      internal.SocketBuffers{Send: o.sndBuf, Recv: o.rcvBuf},
+		SlowBatchThreshold: o.slowBatchThreshold,
+
+		MaxBatchesPerConnection: o.maxBatchesPerConn,
+		TimestampField:          o.timestampField,
+		EventLag:                o.eventLag,
+		Recorder:                o.recordTo,
+		ACKRateLimit:            o.ackRateLimit,
+		MaxHandlerGoroutines:    o.maxHandlerGoroutines,
+		AcceptFunc:              o.acceptFunc,
+		PerIPConnRate:           o.perIPConnRate,
+		PerIPConnBurst:          o.perIPConnBurst,
 	}
 
 	s, err := mk(cfg)
-	return &Server{s}, err
+	return &Server{s: s, stats: stats, settings: o.settings()}, err
 }
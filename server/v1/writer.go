@@ -34,7 +34,7 @@ func newWriter(c net.Conn, to time.Duration) *writer {
 	return &writer{c: c, to: to}
 }
 
-func (w *writer) ACK(n int) error {
+func (w *writer) ACK(n, _ int) error {
 	var buf [6]byte
 	buf[0] = protocol.CodeVersion
 	buf[1] = protocol.CodeACK
@@ -55,7 +55,7 @@ func (w *writer) ACK(n int) error {
 	return nil
 }
 
-func (w *writer) Keepalive(n int) error {
+func (w *writer) Keepalive(n, _ int) error {
 	// keepalive not supported by v1
 	return nil
 }
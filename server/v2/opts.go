@@ -21,9 +21,12 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"io"
+	"net"
 	"time"
 
 	"github.com/elastic/go-lumber/lj"
+	"github.com/elastic/go-lumber/server/internal"
 )
 
 // Option type for configuring server run options.
@@ -35,6 +38,35 @@ type options struct {
 	decoder   jsonDecoder
 	tls       *tls.Config
 	ch        chan *lj.Batch
+
+	maxInFlightBytes      int
+	faultInjector         func(phase string) error
+	ackLatency            func(*lj.Batch, time.Duration)
+	lenientFraming        bool
+	sndBuf                int
+	rcvBuf                int
+	slowBatchThreshold    time.Duration
+	maxBatchesPerConn     int
+	maxDecompressedSize   int
+	maxEvents             int
+	debugACKs             bool
+	timestampField        string
+	eventLag              func(time.Duration)
+	recordTo              io.Writer
+	ackRateLimit          int
+	ackEncoder            func(seq uint32) []byte
+	maxHandlerGoroutines  int
+	deadLetter            func(raw []byte, err error)
+	decrypter             func([]byte) ([]byte, error)
+	minTLSVersion         uint16
+	acceptFunc            func(net.Conn) bool
+	perIPConnRate         int
+	perIPConnBurst        int
+	validate              func(map[string]interface{}) error
+	invalidEvents         InvalidEventPolicy
+	idleTimeout           time.Duration
+	maxFields             int
+	maxEncryptedFrameSize int
 }
 
 // Keepalive configures the keepalive interval returning an ACK of length 0 to
@@ -69,7 +101,10 @@ func Channel(c chan *lj.Batch) Option {
 	}
 }
 
-// TLS enables and configures TLS support in lumberjack server.
+// TLS enables and configures TLS support in lumberjack server. The
+// configuration must provide a server certificate via Certificates,
+// GetCertificate or GetConfigForClient. Plaintext connections are rejected
+// with a logged message.
 func TLS(tls *tls.Config) Option {
 	return func(opt *options) error {
 		opt.tls = tls
@@ -86,6 +121,364 @@ func JSONDecoder(decoder func([]byte, interface{}) error) Option {
 	}
 }
 
+// MaxInFlightBytes limits the total payload size of batches being enqueued,
+// but not yet ACKed. Once the limit is reached, reading new batches from
+// clients is blocked until enough batches have been ACKed. A value of 0
+// disables the limit.
+func MaxInFlightBytes(n int) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("max in-flight bytes must not be negative")
+		}
+		opt.maxInFlightBytes = n
+		return nil
+	}
+}
+
+// FaultInjector installs a callback for testing client behavior on faulty
+// connections. The callback is invoked with the current phase of the
+// conversation ("window", "events" or "ack"). If the callback returns an
+// error, the connection is dropped. Returning ErrCorruptACK in the "ack"
+// phase sends a malformed ACK frame instead. No faults are injected by
+// default.
+func FaultInjector(fn func(phase string) error) Option {
+	return func(opt *options) error {
+		opt.faultInjector = fn
+		return nil
+	}
+}
+
+// ACKLatency registers a callback being called with the time passed between
+// a batch being received and the batch being ACKed by the consumer. The
+// callback must not block.
+func ACKLatency(fn func(b *lj.Batch, latency time.Duration)) Option {
+	return func(opt *options) error {
+		opt.ackLatency = fn
+		return nil
+	}
+}
+
+// LenientFraming relaxes the frame ordering expected from clients. If enabled,
+// data frames received before the window frame are buffered and accounted to
+// the batch once the window frame is received. The number of events buffered
+// is bounded by MaxEvents. Without MaxEvents being set, data frames received
+// before the window frame are rejected. Intended for interoperating with
+// non-conformant clients only.
+func LenientFraming(b bool) Option {
+	return func(opt *options) error {
+		opt.lenientFraming = b
+		return nil
+	}
+}
+
+// SendBufferBytes sets the socket send buffer size of accepted TCP
+// connections. The operating system might round or cap the requested size
+// (e.g. Linux doubles the value and caps it at net.core.wmem_max).
+func SendBufferBytes(n int) Option {
+	return func(opt *options) error {
+		if n <= 0 {
+			return errors.New("send buffer size must be positive")
+		}
+		opt.sndBuf = n
+		return nil
+	}
+}
+
+// RecvBufferBytes sets the socket receive buffer size of accepted TCP
+// connections. The operating system might round or cap the requested size
+// (e.g. Linux doubles the value and caps it at net.core.rmem_max).
+func RecvBufferBytes(n int) Option {
+	return func(opt *options) error {
+		if n <= 0 {
+			return errors.New("receive buffer size must be positive")
+		}
+		opt.rcvBuf = n
+		return nil
+	}
+}
+
+// SlowBatchThreshold enables logging of batches taking longer than d from
+// being received to being ACKed. The log message contains the client address,
+// the number of events and the elapsed time. A value of 0 disables logging.
+func SlowBatchThreshold(d time.Duration) Option {
+	return func(opt *options) error {
+		if d < 0 {
+			return errors.New("slow batch threshold must not be negative")
+		}
+		opt.slowBatchThreshold = d
+		return nil
+	}
+}
+
+// MaxBatchesPerConnection closes client connections after n batches have been
+// received and ACKed, forcing clients to reconnect. This bounds the resources
+// accumulated per connection. A value of 0 disables the limit.
+func MaxBatchesPerConnection(n int) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("max batches per connection must not be negative")
+		}
+		opt.maxBatchesPerConn = n
+		return nil
+	}
+}
+
+// MaxDecompressedSize limits the total size of decompressed payloads per
+// batch. Connections sending batches exceeding the limit are closed. A value
+// of 0 disables the limit.
+func MaxDecompressedSize(n int) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("max decompressed size must not be negative")
+		}
+		opt.maxDecompressedSize = n
+		return nil
+	}
+}
+
+// MaxEvents limits the number of events per batch. Connections announcing or
+// sending more events are closed. With the limit set, connections sending
+// compressed frames holding more events than announced by the window are
+// closed as well. A value of 0 disables the limit.
+func MaxEvents(n int) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("max events must not be negative")
+		}
+		opt.maxEvents = n
+		return nil
+	}
+}
+
+// DebugACKs enables logging of every ACK frame sent to clients, including
+// keepalives, with the client address, the ACKed sequence number and the
+// number of events in the window being ACKed. Intended for debugging
+// compatibility issues with non-standard clients.
+func DebugACKs(b bool) Option {
+	return func(opt *options) error {
+		opt.debugACKs = b
+		return nil
+	}
+}
+
+// TimestampField enables monitoring of the ingest lag. For every received
+// event, the time passed between the event timestamp and the batch being
+// received is passed to fn. The timestamp is read from the named top-level
+// event field and must be formatted as RFC3339 string. Events without valid
+// timestamp are skipped. The callback must not block.
+func TimestampField(name string, fn func(lag time.Duration)) Option {
+	return func(opt *options) error {
+		if name == "" && fn != nil {
+			return errors.New("timestamp field name must not be empty")
+		}
+		opt.timestampField = name
+		opt.eventLag = fn
+		return nil
+	}
+}
+
+// RecordTo enables recording of all received batches to w. Batches are
+// written as newline delimited JSON (see lj.Record) before being forwarded to
+// the receive channel. Recordings can be replayed with the v2 client's
+// ReplayFrom. Recording is stopped on the first write error.
+func RecordTo(w io.Writer) Option {
+	return func(opt *options) error {
+		opt.recordTo = w
+		return nil
+	}
+}
+
+// ACKRateLimit limits the number of batch ACKs sent to clients per second,
+// across all connections. Intended for simulating slow consumers when testing
+// client backpressure. A value of 0 disables the limit.
+func ACKRateLimit(perSecond int) Option {
+	return func(opt *options) error {
+		if perSecond < 0 {
+			return errors.New("ack rate limit must not be negative")
+		}
+		opt.ackRateLimit = perSecond
+		return nil
+	}
+}
+
+// ACKEncoder replaces the binary lumberjack ACK frame with the encoding
+// returned by fn, for interoperability with non-standard clients. fn is
+// called for every ACK and keepalive with the ACKed sequence number. Use
+// EncodeJSONACK for sending ACKs as JSON objects. If fn is nil, the standard
+// lumberjack ACK frame is sent.
+// Note: Standard lumberjack clients fail on ACKs not using the lumberjack
+// encoding.
+func ACKEncoder(fn func(seq uint32) []byte) Option {
+	return func(opt *options) error {
+		opt.ackEncoder = fn
+		return nil
+	}
+}
+
+// MaxHandlerGoroutines limits the number of goroutines spawned for handling
+// client connections. Every connection accounts for the goroutines reading
+// batches, writing ACKs and watching for server shutdown. Connections
+// accepted while the budget is exhausted are closed right away, as lumberjack
+// has no way to report the server being busy. Clients are expected to
+// reconnect with backoff. A value of 0 disables the limit.
+func MaxHandlerGoroutines(n int) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("max handler goroutines must not be negative")
+		}
+		opt.maxHandlerGoroutines = n
+		return nil
+	}
+}
+
+// DeadLetter registers a callback being called with the raw payload of JSON
+// events or metadata failing to be decoded, before the connection is closed.
+// This allows operators to capture malformed input for inspection. The
+// payload buffer is owned by the callback. The callback must not block.
+func DeadLetter(fn func(raw []byte, err error)) Option {
+	return func(opt *options) error {
+		opt.deadLetter = fn
+		return nil
+	}
+}
+
+// PayloadDecrypter decrypts the payload of encrypted data frames sent by
+// clients configured with the v2 client's PayloadEncrypter option. The
+// decrypted payload must be the compressed frame payload. Encrypted frames
+// are rejected with a protocol error if no decrypter is configured. See
+// MaxEncryptedFrameSize for limiting the size of encrypted frames.
+func PayloadDecrypter(fn func(encrypted []byte) ([]byte, error)) Option {
+	return func(opt *options) error {
+		opt.decrypter = fn
+		return nil
+	}
+}
+
+// MinTLSVersion sets the minimum TLS version accepted from clients, e.g.
+// tls.VersionTLS12. A TLS configuration is created if none has been given via
+// the TLS option, which still must provide a server certificate. The TLS
+// configuration passed to the TLS option is not modified.
+func MinTLSVersion(v uint16) Option {
+	return func(opt *options) error {
+		if err := internal.ValidateTLSVersion(v); err != nil {
+			return err
+		}
+		opt.minTLSVersion = v
+		return nil
+	}
+}
+
+// AcceptFunc registers a callback deciding whether to serve a new client
+// connection. fn is called after the TLS handshake, before any batch is read.
+// If fn returns false, the connection is closed and the rejection is logged.
+// The TLS state of a connection can be accessed by asserting the connection
+// to implement ConnectionState() tls.ConnectionState, which also holds for
+// connections of a server multiplexing protocol versions.
+func AcceptFunc(fn func(conn net.Conn) bool) Option {
+	return func(opt *options) error {
+		opt.acceptFunc = fn
+		return nil
+	}
+}
+
+// PerIPConnRateLimit limits how fast new connections from the same source IP
+// are accepted, using a token bucket per IP refilled with perSecond tokens
+// per second and holding up to burst tokens. Connections exceeding the limit
+// are closed right away, such that a single noisy client can not exhaust the
+// server's connection handling. A rate of 0 disables the limit.
+func PerIPConnRateLimit(perSecond, burst int) Option {
+	return func(opt *options) error {
+		if perSecond < 0 {
+			return errors.New("connection rate limit must not be negative")
+		}
+		if perSecond > 0 && burst <= 0 {
+			return errors.New("connection rate burst must be positive")
+		}
+		opt.perIPConnRate = perSecond
+		opt.perIPConnBurst = burst
+		return nil
+	}
+}
+
+// InvalidEventPolicy selects how events failing validation are handled.
+type InvalidEventPolicy int
+
+const (
+	// DropInvalidEvents removes invalid events from the batch. Dropped events
+	// are ACKed to the client and counted by EventsRejected.
+	DropInvalidEvents InvalidEventPolicy = iota
+
+	// RejectInvalidBatch rejects the complete batch, closing the connection
+	// without ACKing the batch.
+	RejectInvalidBatch
+)
+
+// ValidateEvent registers a function validating each decoded event, before
+// the batch is forwarded to the receive channel. Events not being JSON
+// objects are always invalid. Events failing validation are handled
+// according to the policy configured via OnInvalidEvent.
+func ValidateEvent(fn func(evt map[string]interface{}) error) Option {
+	return func(opt *options) error {
+		opt.validate = fn
+		return nil
+	}
+}
+
+// OnInvalidEvent configures the handling of events failing validation or
+// exceeding the field limit. See ValidateEvent and MaxFieldsPerEvent.
+// Defaults to DropInvalidEvents.
+func OnInvalidEvent(p InvalidEventPolicy) Option {
+	return func(opt *options) error {
+		opt.invalidEvents = p
+		return nil
+	}
+}
+
+// IdleTimeout replaces the fixed per batch read timeout with a sliding idle
+// timeout. The read deadline is extended by d after every frame read and
+// every ACK written, such that long-lived connections streaming large batches
+// are not closed mid-stream, while connections without any activity for d
+// are closed. By default no idle timeout is used and connections waiting for
+// the next batch are never closed by the server.
+func IdleTimeout(d time.Duration) Option {
+	return func(opt *options) error {
+		if d < 0 {
+			return errors.New("idle timeout must not be negative")
+		}
+		opt.idleTimeout = d
+		return nil
+	}
+}
+
+// MaxFieldsPerEvent limits the total number of fields per event, including
+// the fields of nested objects, protecting consumers from mapping
+// explosions. Events exceeding the limit are handled like events failing
+// validation, according to the policy configured via OnInvalidEvent.
+// A value of 0 disables the limit.
+func MaxFieldsPerEvent(n int) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("max fields per event must not be negative")
+		}
+		opt.maxFields = n
+		return nil
+	}
+}
+
+// MaxEncryptedFrameSize limits the payload size of encrypted frames. The
+// payload of an encrypted frame is read into memory before being decrypted.
+// Connections sending larger frames are closed, before the payload is read.
+// A value of 0 uses the default limit of 64MiB.
+func MaxEncryptedFrameSize(n int) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("max encrypted frame size must not be negative")
+		}
+		opt.maxEncryptedFrameSize = n
+		return nil
+	}
+}
+
 func applyOptions(opts []Option) (options, error) {
 	o := options{
 		decoder:   json.Unmarshal,
@@ -99,5 +492,34 @@ func applyOptions(opts []Option) (options, error) {
 			return o, err
 		}
 	}
+
+	if o.maxEncryptedFrameSize == 0 {
+		o.maxEncryptedFrameSize = defaultMaxEncryptedFrameSize
+	}
+
+	o.tls = internal.WithMinTLSVersion(o.tls, o.minTLSVersion)
+	if err := internal.ValidateTLS(o.tls); err != nil {
+		return o, err
+	}
 	return o, nil
 }
+
+func (o *options) settings() Settings {
+	st := Settings{
+		V2:          true,
+		Timeout:     o.timeout,
+		Keepalive:   o.keepalive,
+		IdleTimeout: o.idleTimeout,
+		TLS:         o.tls != nil,
+
+		MaxInFlightBytes:        o.maxInFlightBytes,
+		MaxBatchesPerConnection: o.maxBatchesPerConn,
+		MaxHandlerGoroutines:    o.maxHandlerGoroutines,
+		MaxEvents:               o.maxEvents,
+		MaxDecompressedSize:     o.maxDecompressedSize,
+	}
+	if o.tls != nil {
+		st.MinTLSVersion = o.tls.MinVersion
+	}
+	return st
+}
@@ -19,9 +19,11 @@ package v2
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"io"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/klauspost/compress/zlib"
@@ -29,25 +31,75 @@ import (
 	"github.com/elastic/go-lumber/lj"
 	"github.com/elastic/go-lumber/log"
 	protocol "github.com/elastic/go-lumber/protocol/v2"
+	"github.com/elastic/go-lumber/server/internal"
 )
 
 type reader struct {
 	in      *bufio.Reader
 	conn    net.Conn
 	timeout time.Duration
+	idle    time.Duration
+	size    int
 	decoder jsonDecoder
+	fault   func(string) error
 	buf     []byte
+
+	lenient bool
+	pending []interface{} // events received before window frame
+
+	maxEvents           int
+	maxDecompressedSize int
+	decompressed        int // decompressed bytes in current batch
+
+	meta     map[string]interface{} // metadata of current batch
+	connMeta map[string]interface{} // metadata sent outside of a window
+
+	deadLetter   func([]byte, error)
+	decrypter    func([]byte) ([]byte, error)
+	maxEncrypted int
+
+	validate      func(map[string]interface{}) error
+	invalidEvents InvalidEventPolicy
+	maxFields     int
+
+	stats    *internal.CompressionStats
+	rejected *uint64
 }
 
 type jsonDecoder func([]byte, interface{}) error
 
-func newReader(c net.Conn, to time.Duration, jsonDecoder jsonDecoder) *reader {
+const defaultMaxEncryptedFrameSize = 64 << 20
+
+func newReader(
+	c net.Conn,
+	o *options,
+	stats *internal.CompressionStats,
+	rejected *uint64,
+) *reader {
 	r := &reader{
 		in:      bufio.NewReader(c),
 		conn:    c,
-		timeout: to,
-		decoder: jsonDecoder,
+		timeout: o.timeout,
+		idle:    o.idleTimeout,
+		decoder: o.decoder,
+		fault:   o.faultInjector,
+		lenient: o.lenientFraming,
 		buf:     make([]byte, 0, 64),
+
+		maxEvents:           o.maxEvents,
+		maxDecompressedSize: o.maxDecompressedSize,
+
+		deadLetter: o.deadLetter,
+		decrypter:  o.decrypter,
+
+		maxEncrypted: o.maxEncryptedFrameSize,
+
+		validate:      o.validate,
+		invalidEvents: o.invalidEvents,
+		maxFields:     o.maxFields,
+
+		stats:    stats,
+		rejected: rejected,
 	}
 	return r
 }
@@ -55,8 +107,58 @@ func newReader(c net.Conn, to time.Duration, jsonDecoder jsonDecoder) *reader {
 func (r *reader) ReadBatch() (*lj.Batch, error) {
 	// 1. read window size
 	var win [6]byte
-	_ = r.conn.SetReadDeadline(time.Time{}) // wait for next batch without timeout
-	if err := readFull(r.in, win[:]); err != nil {
+	r.setWaitDeadline()
+	if err := readFull(r.in, win[:2]); err != nil {
+		return nil, err
+	}
+
+	// metadata frames outside of a window hold connection metadata, applying
+	// to all batches of the connection
+	for win[0] == protocol.CodeVersion && win[1] == protocol.CodeMetadata {
+		if err := r.setDeadline(); err != nil {
+			return nil, err
+		}
+		if err := r.readMeta(r.in); err != nil {
+			log.Printf("failed to read connection metadata with: %v", err)
+			return nil, err
+		}
+		r.connMeta = r.meta
+
+		r.setWaitDeadline()
+		if err := readFull(r.in, win[:2]); err != nil {
+			return nil, err
+		}
+	}
+
+	r.size = 0
+	r.decompressed = 0
+	r.meta = nil
+	if r.lenient {
+		// buffer data frames received before the window frame
+		for win[0] == protocol.CodeVersion && isDataFrame(win[1]) {
+			if r.maxEvents <= 0 {
+				// buffered events are bounded by MaxEvents only
+				log.Println("Rejecting data frame before window, max events not configured")
+				return nil, ErrProtocolError
+			}
+			if err := r.setDeadline(); err != nil {
+				return nil, err
+			}
+
+			pending, err := r.readFrame(r.in, win[1], r.pending, true)
+			if err != nil {
+				log.Printf("reading frame before window failed with: %v", err)
+				return nil, err
+			}
+			r.pending = pending
+
+			if err := readFull(r.in, win[:2]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := readFull(r.in, win[2:]); err != nil {
 		return nil, err
 	}
 
@@ -69,20 +171,124 @@ func (r *reader) ReadBatch() (*lj.Batch, error) {
 	if count == 0 {
 		return nil, nil
 	}
+	if r.maxEvents > 0 && count > r.maxEvents {
+		log.Printf("Window size %v exceeds max events %v", count, r.maxEvents)
+		return nil, ErrTooManyEvents
+	}
 
-	if err := r.conn.SetReadDeadline(time.Now().Add(r.timeout)); err != nil {
+	if err := r.injectFault("window"); err != nil {
 		return nil, err
 	}
 
-	events, err := r.readEvents(r.in, make([]interface{}, 0, count))
+	if err := r.setDeadline(); err != nil {
+		return nil, err
+	}
+
+	events := make([]interface{}, 0, count)
+	if len(r.pending) > 0 {
+		n := len(r.pending)
+		if n > count {
+			n = count
+		}
+		events = append(events, r.pending[:n]...)
+		r.pending = r.pending[n:]
+		if len(r.pending) == 0 {
+			r.pending = nil
+		}
+	}
+
+	events, err := r.readEvents(r.in, events)
 	if events == nil || err != nil {
 		log.Printf("readEvents failed with: %v", err)
 		return nil, err
 	}
 
-	return lj.NewBatch(events), nil
+	if err := r.injectFault("events"); err != nil {
+		return nil, err
+	}
+
+	var kept []int
+	if r.validate != nil || r.maxFields > 0 {
+		if events, kept, err = r.validateEvents(events); err != nil {
+			return nil, err
+		}
+	}
+
+	b := lj.NewBatchWithSize(events, r.size)
+	b.Meta = r.batchMeta()
+	if kept != nil {
+		b.SetWindow(count, kept)
+	}
+	return b, nil
+}
+
+// validateEvent checks the field limit and runs the configured validation.
+func (r *reader) validateEvent(event interface{}) error {
+	m, ok := event.(map[string]interface{})
+	if !ok {
+		return errNoObject
+	}
+	if r.maxFields > 0 && countFields(m, r.maxFields) > r.maxFields {
+		return errTooManyFields
+	}
+	if r.validate != nil {
+		return r.validate(m)
+	}
+	return nil
+}
+
+// countFields counts the fields of v, including fields of nested objects.
+// Counting stops early once limit is exceeded.
+func countFields(v interface{}, limit int) int {
+	n := 0
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, field := range v {
+			n++
+			if n > limit {
+				return n
+			}
+			n += countFields(field, limit-n)
+		}
+	case []interface{}:
+		for _, elem := range v {
+			if n > limit {
+				return n
+			}
+			n += countFields(elem, limit-n)
+		}
+	}
+	return n
+}
+
+// validateEvents removes events failing validation from events. If events
+// have been dropped, the window index of each remaining event is returned.
+func (r *reader) validateEvents(events []interface{}) ([]interface{}, []int, error) {
+	valid := events[:0]
+	kept := make([]int, 0, len(events))
+	for i, event := range events {
+		err := r.validateEvent(event)
+		if err == nil {
+			valid = append(valid, event)
+			kept = append(kept, i)
+			continue
+		}
+
+		atomic.AddUint64(r.rejected, 1)
+		if r.invalidEvents == RejectInvalidBatch {
+			log.Printf("Rejecting batch with invalid event: %v", err)
+			return nil, nil, ErrInvalidEvent
+		}
+		log.Printf("Dropping invalid event: %v", err)
+	}
+
+	if len(kept) == len(events) {
+		return events, nil, nil
+	}
+	return valid, kept, nil
 }
 
+// readEvents reads frames until the events buffer is full.
 func (r *reader) readEvents(in io.Reader, events []interface{}) ([]interface{}, error) {
 	for len(events) < cap(events) {
 		var hdr [2]byte
@@ -95,28 +301,130 @@ func (r *reader) readEvents(in io.Reader, events []interface{}) ([]interface{},
 			return nil, ErrProtocolError
 		}
 
-		switch hdr[1] {
-		case protocol.CodeJSONDataFrame:
-			event, err := r.readJSONEvent(in)
-			if err != nil {
-				log.Printf("failed to read json event with: %v\n", err)
+		var err error
+		events, err = r.readFrame(in, hdr[1], events, false)
+		if err != nil {
+			return nil, err
+		}
+
+		if r.idle > 0 {
+			if err := r.setDeadline(); err != nil {
 				return nil, err
 			}
-			events = append(events, event)
-		case protocol.CodeCompressed:
-			readEvents, err := r.readCompressed(in, events)
-			if err != nil {
-				return nil, err
+		}
+	}
+	return events, nil
+}
+
+// setWaitDeadline sets the read deadline for waiting for the next batch.
+// Without idle timeout, connections wait for the next batch without timeout.
+func (r *reader) setWaitDeadline() {
+	if r.idle > 0 {
+		_ = r.conn.SetReadDeadline(time.Now().Add(r.idle))
+	} else {
+		_ = r.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// batchMeta returns the metadata of the current batch, merged with the
+// connection metadata. Batch metadata takes precedence.
+func (r *reader) batchMeta() map[string]interface{} {
+	if r.connMeta == nil {
+		return r.meta
+	}
+
+	meta := make(map[string]interface{}, len(r.connMeta)+len(r.meta))
+	for k, v := range r.connMeta {
+		meta[k] = v
+	}
+	for k, v := range r.meta {
+		meta[k] = v
+	}
+	return meta
+}
+
+// setDeadline sets the read deadline for reading a batch. Without idle
+// timeout, the deadline is set once per batch. With idle timeout, the
+// deadline is extended after every frame.
+func (r *reader) setDeadline() error {
+	to := r.timeout
+	if r.idle > 0 {
+		to = r.idle
+	}
+	return r.conn.SetReadDeadline(time.Now().Add(to))
+}
+
+// readNestedEvents reads frames from a compressed frame's payload until in
+// is exhausted. Unless all is set, reading stops early once the events buffer
+// is full.
+func (r *reader) readNestedEvents(
+	in io.Reader,
+	events []interface{},
+	all bool,
+) ([]interface{}, error) {
+	for all || len(events) < cap(events) {
+		var hdr [2]byte
+		if _, err := io.ReadFull(in, hdr[:]); err != nil {
+			if err == io.EOF {
+				return events, nil
 			}
-			events = readEvents
-		default:
-			log.Printf("Unknown frame type: %v", hdr[1])
+			return nil, err
+		}
+
+		if hdr[0] != protocol.CodeVersion {
+			log.Println("Event protocol version error")
 			return nil, ErrProtocolError
 		}
+
+		var err error
+		events, err = r.readFrame(in, hdr[1], events, all)
+		if err != nil {
+			return nil, err
+		}
+
+		if r.idle > 0 {
+			if err := r.setDeadline(); err != nil {
+				return nil, err
+			}
+		}
 	}
 	return events, nil
 }
 
+func (r *reader) readFrame(
+	in io.Reader,
+	code byte,
+	events []interface{},
+	all bool,
+) ([]interface{}, error) {
+	switch code {
+	case protocol.CodeJSONDataFrame:
+		event, err := r.readJSONEvent(in)
+		if err != nil {
+			log.Printf("failed to read json event with: %v\n", err)
+			return nil, err
+		}
+		if r.maxEvents > 0 && len(events) >= r.maxEvents {
+			log.Printf("Batch exceeds max events %v", r.maxEvents)
+			return nil, ErrTooManyEvents
+		}
+		return append(events, event), nil
+	case protocol.CodeCompressed:
+		return r.readCompressed(in, events, all)
+	case protocol.CodeEncrypted:
+		return r.readEncrypted(in, events, all)
+	case protocol.CodeMetadata:
+		if err := r.readMeta(in); err != nil {
+			log.Printf("failed to read metadata with: %v\n", err)
+			return nil, err
+		}
+		return events, nil
+	default:
+		log.Printf("Unknown frame type: %v", code)
+		return nil, ErrProtocolError
+	}
+}
+
 func (r *reader) readJSONEvent(in io.Reader) (interface{}, error) {
 	var hdr [8]byte
 	if err := readFull(in, hdr[:]); err != nil {
@@ -124,6 +432,12 @@ func (r *reader) readJSONEvent(in io.Reader) (interface{}, error) {
 	}
 
 	payloadSz := int(binary.BigEndian.Uint32(hdr[4:]))
+	if _, limited := in.(*decompressLimitReader); limited && r.maxDecompressedSize > 0 &&
+		r.decompressed+payloadSz > r.maxDecompressedSize {
+		// fail early, without allocating a buffer for the payload
+		log.Printf("Batch exceeds max decompressed size %v", r.maxDecompressedSize)
+		return nil, ErrDecompressedSizeExceeded
+	}
 	if payloadSz > len(r.buf) {
 		r.buf = make([]byte, payloadSz)
 	}
@@ -132,31 +446,123 @@ func (r *reader) readJSONEvent(in io.Reader) (interface{}, error) {
 	if err := readFull(in, buf); err != nil {
 		return nil, err
 	}
+	r.size += payloadSz
 
 	var event interface{}
-	err := r.decoder(buf, &event)
-	return event, err
+	if err := r.decoder(buf, &event); err != nil {
+		r.reportDeadLetter(buf, err)
+		return nil, err
+	}
+	return event, nil
 }
 
-func (r *reader) readCompressed(in io.Reader, events []interface{}) ([]interface{}, error) {
+func (r *reader) readMeta(in io.Reader) error {
+	var hdr [4]byte
+	if err := readFull(in, hdr[:]); err != nil {
+		return err
+	}
+
+	payloadSz := int(binary.BigEndian.Uint32(hdr[:]))
+	if payloadSz > len(r.buf) {
+		r.buf = make([]byte, payloadSz)
+	}
+
+	buf := r.buf[:payloadSz]
+	if err := readFull(in, buf); err != nil {
+		return err
+	}
+	r.size += payloadSz
+
+	var meta map[string]interface{}
+	if err := r.decoder(buf, &meta); err != nil {
+		r.reportDeadLetter(buf, err)
+		return err
+	}
+	r.meta = meta
+	return nil
+}
+
+func (r *reader) readCompressed(
+	in io.Reader,
+	events []interface{},
+	all bool,
+) ([]interface{}, error) {
+	var hdr [4]byte
+	if err := readFull(in, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	payloadSz := binary.BigEndian.Uint32(hdr[:])
+	return r.readZlib(io.LimitReader(in, int64(payloadSz)), int(payloadSz), events, all)
+}
+
+func (r *reader) readEncrypted(
+	in io.Reader,
+	events []interface{},
+	all bool,
+) ([]interface{}, error) {
+	if r.decrypter == nil {
+		log.Println("Received encrypted frame, but no payload decrypter configured")
+		return nil, ErrProtocolError
+	}
+
 	var hdr [4]byte
 	if err := readFull(in, hdr[:]); err != nil {
 		return nil, err
 	}
 
 	payloadSz := binary.BigEndian.Uint32(hdr[:])
-	limit := io.LimitReader(in, int64(payloadSz))
+	if uint64(payloadSz) > uint64(r.maxEncrypted) {
+		// fail early, without allocating a buffer for the payload
+		log.Printf("Encrypted frame of %v bytes exceeds max size %v", payloadSz, r.maxEncrypted)
+		return nil, ErrFrameTooLarge
+	}
+
+	encrypted := make([]byte, payloadSz)
+	if err := readFull(in, encrypted); err != nil {
+		return nil, err
+	}
+
+	payload, err := r.decrypter(encrypted)
+	if err != nil {
+		log.Printf("Failed to decrypt frame: %v", err)
+		return nil, err
+	}
+	return r.readZlib(bytes.NewReader(payload), len(encrypted), events, all)
+}
+
+// readZlib reads the events of a compressed frame payload. limit must return
+// io.EOF at the end of the payload. size is the frame's payload size
+// received.
+func (r *reader) readZlib(
+	limit io.Reader,
+	size int,
+	events []interface{},
+	all bool,
+) ([]interface{}, error) {
 	reader, err := zlib.NewReader(limit)
 	if err != nil {
 		log.Printf("Failed to initialized zlib reader %v\n", err)
 		return nil, err
 	}
 
-	events, err = r.readEvents(reader, events)
+	before := r.decompressed
+	payload := &decompressLimitReader{r: r, in: reader}
+
+	events, err = r.readNestedEvents(payload, events, all)
 	if err != nil {
 		_ = reader.Close()
 		return nil, err
 	}
+	if !all && r.maxEvents > 0 && len(events) == cap(events) {
+		// frames left in the payload hold more events than announced
+		var tmp [1]byte
+		if n, _ := io.ReadFull(payload, tmp[:]); n > 0 {
+			_ = reader.Close()
+			log.Println("Compressed frame holds more events than announced by window")
+			return nil, ErrTooManyEvents
+		}
+	}
 	if err := reader.Close(); err != nil {
 		return nil, err
 	}
@@ -171,9 +577,65 @@ func (r *reader) readCompressed(in io.Reader, events []interface{}) ([]interface
 			break
 		}
 	}
+
+	r.stats.Add(size, r.decompressed-before)
 	return events, nil
 }
 
+// decompressLimitReader counts the decompressed bytes read in the current
+// batch. If maxDecompressedSize is set, reading fails with
+// ErrDecompressedSizeExceeded once the limit is exceeded.
+type decompressLimitReader struct {
+	r  *reader
+	in io.Reader
+}
+
+func (l *decompressLimitReader) Read(p []byte) (int, error) {
+	max := l.r.maxDecompressedSize
+	if max <= 0 {
+		n, err := l.in.Read(p)
+		l.r.decompressed += n
+		return n, err
+	}
+
+	// read at most one byte past the limit, for detecting the limit being
+	// exceeded
+	remaining := max - l.r.decompressed
+	if len(p) > remaining+1 {
+		p = p[:remaining+1]
+	}
+
+	n, err := l.in.Read(p)
+	l.r.decompressed += n
+	if l.r.decompressed > max {
+		log.Printf("Batch exceeds max decompressed size %v", l.r.maxDecompressedSize)
+		return n, ErrDecompressedSizeExceeded
+	}
+	return n, err
+}
+
+// reportDeadLetter passes a copy of a payload failing to be decoded to the
+// DeadLetter callback.
+func (r *reader) reportDeadLetter(raw []byte, err error) {
+	if r.deadLetter == nil {
+		return
+	}
+	r.deadLetter(append([]byte(nil), raw...), err)
+}
+
+func (r *reader) injectFault(phase string) error {
+	if r.fault == nil {
+		return nil
+	}
+	return r.fault(phase)
+}
+
+func isDataFrame(code byte) bool {
+	return code == protocol.CodeJSONDataFrame ||
+		code == protocol.CodeCompressed ||
+		code == protocol.CodeEncrypted
+}
+
 func readFull(in io.Reader, buf []byte) error {
 	_, err := io.ReadFull(in, buf)
 	return err
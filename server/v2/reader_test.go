@@ -0,0 +1,231 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v2
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/elastic/go-lumber/server/internal"
+)
+
+// newTestReader creates a reader for the server side of an in-memory
+// connection. The frames are written by the client side.
+func newTestReader(t *testing.T, frames []byte, opts ...Option) *reader {
+	o, err := applyOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	go client.Write(frames)
+	return newReader(server, &o, &internal.CompressionStats{}, new(uint64))
+}
+
+func windowFrame(n int) string {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(n))
+	return "2W" + string(b[:])
+}
+
+func jsonFrame(seq int, payload string) string {
+	var b [8]byte
+	binary.BigEndian.PutUint32(b[:4], uint32(seq))
+	binary.BigEndian.PutUint32(b[4:], uint32(len(payload)))
+	return "2J" + string(b[:]) + payload
+}
+
+func compressedFrame(t *testing.T, frames ...string) string {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	if _, err := w.Write([]byte(strings.Join(frames, ""))); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(buf.Len()))
+	return "2C" + string(b[:]) + buf.String()
+}
+
+func jsonFrames(n int) []string {
+	frames := make([]string, n)
+	for i := range frames {
+		frames[i] = jsonFrame(i+1, `{"message":"hello"}`)
+	}
+	return frames
+}
+
+func TestReadCompressedLimits(t *testing.T) {
+	// payload decompressing to 1MB of whitespace
+	bomb := jsonFrame(1, strings.Repeat(" ", 1<<20)+"{}")
+
+	tests := map[string]struct {
+		opts     []Option
+		frames   func(t *testing.T) string
+		expected error
+		events   int
+	}{
+		"within limits": {
+			opts: []Option{MaxEvents(2), MaxDecompressedSize(1024)},
+			frames: func(t *testing.T) string {
+				return windowFrame(2) + compressedFrame(t, jsonFrames(2)...)
+			},
+			events: 2,
+		},
+		"decompression bomb": {
+			opts: []Option{MaxDecompressedSize(1024)},
+			frames: func(t *testing.T) string {
+				return windowFrame(1) + compressedFrame(t, bomb)
+			},
+			expected: ErrDecompressedSizeExceeded,
+		},
+		"decompressed events exceed limit": {
+			opts: []Option{MaxDecompressedSize(1024)},
+			frames: func(t *testing.T) string {
+				return windowFrame(100) + compressedFrame(t, jsonFrames(100)...)
+			},
+			expected: ErrDecompressedSizeExceeded,
+		},
+		"nested compressed frames share limit": {
+			opts: []Option{MaxDecompressedSize(1024)},
+			frames: func(t *testing.T) string {
+				nested := compressedFrame(t, jsonFrames(50)...)
+				return windowFrame(100) + compressedFrame(t, nested, nested)
+			},
+			expected: ErrDecompressedSizeExceeded,
+		},
+		"window exceeds max events": {
+			opts: []Option{MaxEvents(2)},
+			frames: func(t *testing.T) string {
+				return windowFrame(3) + compressedFrame(t, jsonFrames(3)...)
+			},
+			expected: ErrTooManyEvents,
+		},
+		"compressed frame exceeds window": {
+			opts: []Option{MaxEvents(10)},
+			frames: func(t *testing.T) string {
+				return windowFrame(2) + compressedFrame(t, jsonFrames(3)...)
+			},
+			expected: ErrTooManyEvents,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := newTestReader(t, []byte(test.frames(t)), test.opts...)
+
+			batch, err := r.ReadBatch()
+			if err != test.expected {
+				t.Fatalf("expected error %v, got %v", test.expected, err)
+			}
+			if err != nil {
+				return
+			}
+			if len(batch.Events) != test.events {
+				t.Errorf("expected %v events, got %v", test.events, len(batch.Events))
+			}
+		})
+	}
+}
+
+func TestReadLenientFraming(t *testing.T) {
+	tests := map[string]struct {
+		opts     []Option
+		frames   string
+		expected error
+		events   int
+	}{
+		"frames before window": {
+			opts:   []Option{LenientFraming(true), MaxEvents(5)},
+			frames: strings.Join(jsonFrames(2), "") + windowFrame(2),
+			events: 2,
+		},
+		"max events not configured": {
+			opts:     []Option{LenientFraming(true)},
+			frames:   strings.Join(jsonFrames(2), "") + windowFrame(2),
+			expected: ErrProtocolError,
+		},
+		"buffered frames exceed max events": {
+			opts:     []Option{LenientFraming(true), MaxEvents(2)},
+			frames:   strings.Join(jsonFrames(3), "") + windowFrame(2),
+			expected: ErrTooManyEvents,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := newTestReader(t, []byte(test.frames), test.opts...)
+
+			batch, err := r.ReadBatch()
+			if err != test.expected {
+				t.Fatalf("expected error %v, got %v", test.expected, err)
+			}
+			if err != nil {
+				return
+			}
+			if len(batch.Events) != test.events {
+				t.Errorf("expected %v events, got %v", test.events, len(batch.Events))
+			}
+		})
+	}
+}
+
+func TestReadEncryptedFrameTooLarge(t *testing.T) {
+	decrypter := func(b []byte) ([]byte, error) {
+		t.Error("decrypter must not be called")
+		return b, nil
+	}
+
+	tests := map[string]struct {
+		opts []Option
+		hdr  string
+	}{
+		"default limit": {
+			hdr: "\xff\xff\xff\xff",
+		},
+		"custom limit": {
+			opts: []Option{MaxEncryptedFrameSize(1024)},
+			hdr:  "\x00\x00\x04\x01",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			opts := append([]Option{PayloadDecrypter(decrypter)}, test.opts...)
+			frames := "2W\x00\x00\x00\x01" + "2E" + test.hdr
+			r := newTestReader(t, []byte(frames), opts...)
+
+			batch, err := r.ReadBatch()
+			if err != ErrFrameTooLarge {
+				t.Fatalf("expected %v, got batch=%v, err=%v", ErrFrameTooLarge, batch, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v2
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-lumber/lj"
+	"github.com/elastic/go-lumber/server/internal"
+)
+
+func newTestServer(t *testing.T, opts ...Option) *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewWithListener(l, opts...)
+	if err != nil {
+		l.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func dialTestServer(t *testing.T, s *Server) net.Conn {
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func readACK(t *testing.T, conn net.Conn) string {
+	var buf [6]byte
+	if _, err := io.ReadFull(conn, buf[:]); err != nil {
+		t.Fatalf("failed to read ACK: %v", err)
+	}
+	return string(buf[:])
+}
+
+func TestEmptyWindowACK(t *testing.T) {
+	s := newTestServer(t, Keepalive(0))
+	conn := dialTestServer(t, s)
+
+	if _, err := conn.Write([]byte(windowFrame(0))); err != nil {
+		t.Fatal(err)
+	}
+	if ack := readACK(t, conn); ack != "2A\x00\x00\x00\x00" {
+		t.Fatalf("expected ACK 0, got %q", ack)
+	}
+
+	// the next batch received must be the batch following the empty window
+	frames := windowFrame(1) + jsonFrame(1, `{"message":"hello"}`)
+	if _, err := conn.Write([]byte(frames)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case b := <-s.ReceiveChan():
+		if len(b.Events) != 1 {
+			t.Fatalf("expected 1 event, got %v", b.Events)
+		}
+		b.ACK()
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for batch")
+	}
+	if ack := readACK(t, conn); ack != "2A\x00\x00\x00\x01" {
+		t.Fatalf("expected ACK 1, got %q", ack)
+	}
+
+	if n := s.BatchesReceived(); n != 1 {
+		t.Errorf("expected 1 batch received, got %v", n)
+	}
+}
+
+func TestMaxInFlightBytesWithReconnects(t *testing.T) {
+	s := newTestServer(t, MaxInFlightBytes(10))
+	frames := windowFrame(1) + jsonFrame(1, `{"message":"hello"}`)
+
+	// every client sends a batch exceeding the limit and disconnects right
+	// away, leaving the batch unACKed
+	for i := 0; i < 3; i++ {
+		conn := dialTestServer(t, s)
+		if _, err := conn.Write([]byte(frames)); err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+
+	var batch *lj.Batch
+	select {
+	case batch = <-s.ReceiveChan():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for batch")
+	}
+
+	// batches of closed connections must not be admitted, until the batch
+	// holding the bytes has been ACKed
+	time.Sleep(100 * time.Millisecond)
+	if n := s.InFlight(); n != 1 {
+		t.Fatalf("expected 1 batch in flight, got %v", n)
+	}
+
+	batch.ACK()
+	select {
+	case b := <-s.ReceiveChan():
+		b.ACK()
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for batch after ACK")
+	}
+}
+
+func TestShutdownTimeoutClosesServer(t *testing.T) {
+	s := newTestServer(t)
+	conn := dialTestServer(t, s)
+
+	frames := windowFrame(1) + jsonFrame(1, `{"message":"hello"}`)
+	if _, err := conn.Write([]byte(frames)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-s.ReceiveChan(): // batch is never ACKed
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for batch")
+	}
+
+	err := internal.ShutdownWithTimeout(s, 50*time.Millisecond)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	select {
+	case <-s.Done():
+	default:
+		t.Fatal("server not closed after shutdown timeout")
+	}
+}
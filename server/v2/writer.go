@@ -19,32 +19,84 @@ package v2
 
 import (
 	"encoding/binary"
+	"fmt"
 	"net"
 	"time"
 
+	"github.com/elastic/go-lumber/log"
 	protocol "github.com/elastic/go-lumber/protocol/v2"
 )
 
 type writer struct {
-	c  net.Conn
-	to time.Duration
+	c      net.Conn
+	to     time.Duration
+	idle   time.Duration
+	fault  func(string) error
+	debug  bool
+	encode func(seq uint32) []byte
 }
 
-func newWriter(c net.Conn, to time.Duration) *writer {
-	return &writer{c: c, to: to}
+func newWriter(c net.Conn, o *options) *writer {
+	encode := o.ackEncoder
+	if encode == nil {
+		encode = encodeACK
+	}
+	return &writer{
+		c:      c,
+		to:     o.timeout,
+		idle:   o.idleTimeout,
+		fault:  o.faultInjector,
+		debug:  o.debugACKs,
+		encode: encode,
+	}
 }
 
-func (w *writer) ACK(n int) error {
-	var buf [6]byte
+// EncodeJSONACK encodes an ACK as newline terminated JSON object of the form
+// {"seq":N}. See ACKEncoder.
+func EncodeJSONACK(seq uint32) []byte {
+	return []byte(fmt.Sprintf("{\"seq\":%d}\n", seq))
+}
+
+func encodeACK(seq uint32) []byte {
+	buf := make([]byte, 6)
 	buf[0] = protocol.CodeVersion
 	buf[1] = protocol.CodeACK
-	binary.BigEndian.PutUint32(buf[2:], uint32(n))
+	binary.BigEndian.PutUint32(buf[2:], seq)
+	return buf
+}
+
+func (w *writer) ACK(n, count int) error {
+	return w.send("ACK", n, count)
+}
+
+func (w *writer) Keepalive(n, count int) error {
+	return w.send("Keepalive", n, count)
+}
+
+func (w *writer) send(kind string, n, count int) error {
+	buf := w.encode(uint32(n))
+
+	if w.fault != nil {
+		switch err := w.fault("ack"); err {
+		case nil:
+		case ErrCorruptACK:
+			if len(buf) > 1 {
+				buf[1] = 0
+			}
+		default:
+			return err
+		}
+	}
+
+	if w.debug {
+		log.Printf("%v to %v: seq=%v count=%v", kind, w.c.RemoteAddr(), n, count)
+	}
 
 	if err := w.c.SetWriteDeadline(time.Now().Add(w.to)); err != nil {
 		return err
 	}
 
-	tmp := buf[:]
+	tmp := buf
 	for len(tmp) > 0 {
 		n, err := w.c.Write(tmp)
 		if err != nil {
@@ -52,9 +104,11 @@ func (w *writer) ACK(n int) error {
 		}
 		tmp = tmp[n:]
 	}
-	return nil
-}
 
-func (w *writer) Keepalive(n int) error {
-	return w.ACK(n)
+	if w.idle > 0 {
+		// ACKs count as activity, keeping connections of clients waiting for
+		// slow batches alive
+		return w.c.SetReadDeadline(time.Now().Add(w.idle))
+	}
+	return nil
 }